@@ -0,0 +1,365 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWriterClosed is returned when writing to an AsyncWriter after it
+// was closed.
+var ErrWriterClosed = errors.New("gelf: writer closed")
+
+// AsyncWriter is a Writer whose WriteMessage, WriteMessages, WriteRaw
+// and Write only queue the message, leaving the sending to a
+// background goroutine, so that logging doesn't add network latency
+// to the caller.  Messages that queue up while others are being sent
+// are sent together, with Writer.WriteMessages.  Errors met while
+// sending are reported by Flush and Close.
+//
+// The embedded Writer's settings may only be changed before the first
+// message is written.
+type AsyncWriter struct {
+	*Writer
+
+	mu      sync.RWMutex // held for writing only to close queue
+	closed  bool
+	queue   chan asyncItem
+	policy  OverflowPolicy
+	dropped atomic.Uint64
+	linger  atomic.Int64 // flush interval, as a time.Duration
+	done    chan struct{}
+
+	errMu sync.Mutex
+	err   error
+}
+
+// asyncItem is either a message to send, a raw payload to send, or a
+// flush request: flushed is closed once everything queued before it
+// was sent.
+type asyncItem struct {
+	msg     *Message
+	raw     []byte
+	flushed chan struct{}
+}
+
+// NewAsyncWriter returns an AsyncWriter sending to addr, which queues
+// up to bufferSize messages.  Writing to a full queue blocks until
+// there is room, unless SetOverflowPolicy says otherwise.
+func NewAsyncWriter(addr string, bufferSize int) (*AsyncWriter, error) {
+	if bufferSize < 0 {
+		return nil, fmt.Errorf("invalid buffer size %d", bufferSize)
+	}
+
+	w, err := NewWriter(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAsyncWriter(w, bufferSize), nil
+}
+
+func newAsyncWriter(w *Writer, bufferSize int) *AsyncWriter {
+	aw := &AsyncWriter{
+		Writer: w,
+		queue:  make(chan asyncItem, bufferSize),
+		done:   make(chan struct{}),
+	}
+
+	go aw.loop()
+
+	return aw
+}
+
+// SetOverflowPolicy sets what to do with messages written while the
+// queue is full: OverflowBlock, the default, waits for room, and
+// OverflowDropNewest discards them, counting them in DroppedMessages.
+func (w *AsyncWriter) SetOverflowPolicy(policy OverflowPolicy) error {
+	if policy != OverflowBlock && policy != OverflowDropNewest {
+		return fmt.Errorf("unknown overflow policy %d", policy)
+	}
+
+	w.mu.Lock()
+	w.policy = policy
+	w.mu.Unlock()
+
+	return nil
+}
+
+// SetFlushInterval makes the background goroutine wait for up to d
+// after taking a message off the queue, gathering the messages written
+// meanwhile into the same batch, so that messages logged a few at a
+// time still go out together.  A batch is sent once d has passed since
+// its first message, or as soon as it is full or Flush or Close is
+// called.  With d zero, the default, a batch is sent as soon as the
+// queue is drained, without waiting for more.
+func (w *AsyncWriter) SetFlushInterval(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid flush interval %s", d)
+	}
+	w.linger.Store(int64(d))
+	return nil
+}
+
+// DroppedMessages returns the number of messages discarded because the
+// queue was full, with the OverflowDropNewest policy, or because
+// sending them failed, including those that took longer than the
+// Writer's SetWriteTimeout.
+func (w *AsyncWriter) DroppedMessages() uint64 {
+	return w.dropped.Load()
+}
+
+// WriteMessage queues m to be sent.  m must not be modified
+// afterwards, since it is marshaled by the background goroutine.
+func (w *AsyncWriter) WriteMessage(m *Message) error {
+	// the background goroutine can't tell who queued m
+	return w.enqueue(asyncItem{msg: w.withCaller(m, 1)})
+}
+
+// WriteMessages queues every message of msgs, as WriteMessage does.
+// Messages queued together are sent together only if they are taken
+// off the queue in the same batch.
+func (w *AsyncWriter) WriteMessages(msgs []*Message) error {
+	for _, m := range msgs {
+		if err := w.enqueue(asyncItem{msg: w.withCaller(m, 1)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRaw queues a copy of payload to be sent as Writer.WriteRaw
+// sends it.
+func (w *AsyncWriter) WriteRaw(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("WriteRaw: empty payload")
+	}
+	return w.enqueue(asyncItem{raw: append([]byte(nil), payload...)})
+}
+
+// enqueue queues item, as the overflow policy says.
+func (w *AsyncWriter) enqueue(item asyncItem) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	if w.policy == OverflowDropNewest {
+		select {
+		case w.queue <- item:
+		default:
+			w.dropped.Add(1)
+		}
+		return nil
+	}
+
+	w.queue <- item
+	return nil
+}
+
+// Write queues p as a message, built as Writer.Write does.
+func (w *AsyncWriter) Write(p []byte) (n int, err error) {
+	// 1 for the function that called us.
+	file, line := getCallerIgnoringLogMulti(1)
+
+	// remove trailing and leading whitespace
+	p = bytes.TrimSpace(p)
+
+	m := lineMessage(p, w.hostname, w.Facility, file, line)
+	if w.callerInfo {
+		m.File, m.Line = file, int32(line)
+	}
+	if err = w.WriteMessage(m); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Flush waits until every message queued so far was sent, and returns
+// the first error met sending messages since the previous Flush.
+func (w *AsyncWriter) Flush() error {
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return ErrWriterClosed
+	}
+	flushed := make(chan struct{})
+	w.queue <- asyncItem{flushed: flushed}
+	w.mu.RUnlock()
+
+	<-flushed
+
+	return w.takeErr()
+}
+
+// Close sends the messages still queued, then closes the connection.
+// It returns the first error met sending messages since the last
+// Flush, if any, or else the error closing the connection.
+func (w *AsyncWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	<-w.done
+
+	err := w.takeErr()
+	if cerr := w.Writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Most messages the background goroutine sends in one WriteMessages.
+const maxAsyncBatch = 64
+
+// loop sends the queued messages, in batches of those that queued up
+// while the previous batch was being sent, or within the flush
+// interval of the first message of the batch.
+func (w *AsyncWriter) loop() {
+	defer close(w.done)
+
+	batch := make([]*Message, 0, maxAsyncBatch)
+	var carried *asyncItem // taken off the queue while gathering a batch
+	for {
+		var item asyncItem
+		if carried != nil {
+			item, carried = *carried, nil
+		} else if next, ok := <-w.queue; ok {
+			item = next
+		} else {
+			return
+		}
+
+		switch {
+		case item.flushed != nil:
+			close(item.flushed)
+			continue
+		case item.raw != nil:
+			w.record(w.sendRaw(item.raw))
+			continue
+		}
+
+		var timer *time.Timer
+		if d := time.Duration(w.linger.Load()); d > 0 {
+			timer = time.NewTimer(d)
+		}
+
+		batch = append(batch[:0], item.msg)
+	gather:
+		for len(batch) < maxAsyncBatch {
+			var next asyncItem
+			var ok bool
+			if timer == nil {
+				select {
+				case next, ok = <-w.queue:
+				default:
+					break gather
+				}
+			} else {
+				select {
+				case next, ok = <-w.queue:
+				case <-timer.C:
+					break gather
+				}
+			}
+
+			if !ok {
+				break
+			}
+			if next.msg == nil {
+				// a flush or raw payload, dealt with after the batch
+				carried = &next
+				break
+			}
+			batch = append(batch, next.msg)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		w.record(w.send(batch))
+		for i := range batch {
+			batch[i] = nil
+		}
+	}
+}
+
+// record keeps err, if it is the first error met since the last
+// Flush.
+func (w *AsyncWriter) record(err error) {
+	if err == nil {
+		return
+	}
+	w.errMu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.errMu.Unlock()
+}
+
+// sendRaw writes payload, counting it as dropped if that failed, and
+// reporting the error unless it is a timeout.
+func (w *AsyncWriter) sendRaw(payload []byte) error {
+	err := w.Writer.WriteRaw(payload)
+	if err == nil {
+		return nil
+	}
+	w.dropped.Add(1)
+	if errors.Is(err, ErrWriteTimeout) {
+		return nil
+	}
+	return err
+}
+
+// send writes batch, going on with the rest of it when a message
+// fails, and returns the first error met.  The messages that weren't
+// sent are counted as dropped; those lost to SetWriteTimeout aren't
+// reported as errors.
+func (w *AsyncWriter) send(batch []*Message) error {
+	var first error
+	for len(batch) > 0 {
+		err := w.Writer.WriteMessages(batch)
+		if err == nil {
+			break
+		}
+		timedOut := errors.Is(err, ErrWriteTimeout)
+		if first == nil && !timedOut {
+			first = err
+		}
+
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) || errors.Is(err, ErrWriterClosed) ||
+			timedOut && w.Writer.tcp != nil {
+			// the whole batch went in the write that failed
+			w.dropped.Add(uint64(len(batch)))
+			break
+		}
+		w.dropped.Add(1)
+		batch = batch[batchErr.Index+1:]
+	}
+	return first
+}
+
+func (w *AsyncWriter) takeErr() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+
+	err := w.err
+	w.err = nil
+	return err
+}
@@ -0,0 +1,299 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncWriterFlush(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewAsyncWriter(r.Addr(), 16)
+	if err != nil {
+		t.Fatalf("NewAsyncWriter: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != fmt.Sprint(i) {
+			t.Errorf("msg.Short: expected %d, got %s", i, msg.Short)
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "late"}); err != ErrWriterClosed {
+		t.Errorf("WriteMessage after Close: expected ErrWriterClosed, got %v", err)
+	}
+}
+
+// stallConn holds every Write until release is closed, and counts
+// the writes.
+type stallConn struct {
+	net.Conn
+	release chan struct{}
+	mu      sync.Mutex
+	writes  int
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	<-c.release
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *stallConn) Close() error {
+	return nil
+}
+
+func TestAsyncWriterDropNewest(t *testing.T) {
+	conn := &stallConn{release: make(chan struct{})}
+	w := newAsyncWriter(&Writer{conn: conn, CompressionType: CompressNone}, 2)
+	if err := w.SetOverflowPolicy(OverflowDropNewest); err != nil {
+		t.Fatalf("SetOverflowPolicy: %s", err)
+	}
+
+	// the background goroutine takes at most one batch of three
+	// messages, stalling on it, and the queue holds two more
+	for i := 0; i < 10; i++ {
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	if dropped := w.DroppedMessages(); dropped < 5 {
+		t.Errorf("DroppedMessages: expected at least 5, got %d", dropped)
+	}
+
+	close(conn.release)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if total := uint64(conn.writes) + w.DroppedMessages(); total != 10 {
+		t.Errorf("expected 10 messages sent or dropped, got %d", total)
+	}
+}
+
+func TestAsyncWriterFlushInterval(t *testing.T) {
+	conn := &stallConn{release: make(chan struct{})}
+	close(conn.release)
+	tw := &Writer{tcp: &tcpTransport{conn: conn, done: make(chan struct{})}}
+	w := newAsyncWriter(tw, 16)
+	defer w.Close()
+
+	if err := w.SetFlushInterval(-time.Second); err == nil {
+		t.Errorf("SetFlushInterval accepted a negative interval")
+	}
+	if err := w.SetFlushInterval(time.Hour); err != nil {
+		t.Fatalf("SetFlushInterval: %s", err)
+	}
+
+	writes := func() int {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.writes
+	}
+
+	// Flush doesn't wait for the interval
+	for i := 0; i < 3; i++ {
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"})
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if n := writes(); n != 1 {
+		t.Errorf("expected the messages sent in 1 write, got %d", n)
+	}
+
+	// messages written within the interval are sent together, once it
+	// has passed
+	w.SetFlushInterval(50 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"})
+	}
+	for writes() < 2 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("messages held past the flush interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("messages sent after %s, before the flush interval", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := writes(); n != 2 {
+		t.Errorf("expected the messages sent in 1 more write, got %d", n-1)
+	}
+}
+
+// tests that the flush interval ends batches that keep growing
+func TestAsyncWriterFlushIntervalUnderLoad(t *testing.T) {
+	conn := &stallConn{release: make(chan struct{})}
+	close(conn.release)
+	tw := &Writer{tcp: &tcpTransport{conn: conn, done: make(chan struct{})}}
+	w := newAsyncWriter(tw, 64)
+	w.SetFlushInterval(20 * time.Millisecond)
+
+	// fewer than a full batch, written over several intervals
+	const n = 40
+	for i := 0; i < n; i++ {
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"})
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if conn.writes < 2 || conn.writes >= n {
+		t.Errorf("expected a few batches, got %d writes for %d messages", conn.writes, n)
+	}
+}
+
+func TestAsyncWriterWriteTimeout(t *testing.T) {
+	conn := &deadlineConn{stalled: true}
+	w := newAsyncWriter(&Writer{conn: conn, CompressionType: CompressNone}, 16)
+	if err := w.SetWriteTimeout(10 * time.Millisecond); err != nil {
+		t.Fatalf("SetWriteTimeout: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Errorf("Flush: expected timed out messages to be dropped, got %v", err)
+	}
+	if dropped := w.DroppedMessages(); dropped != 3 {
+		t.Errorf("DroppedMessages: expected 3, got %d", dropped)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+// gateConn holds every Write until release is closed, then passes it
+// on to the Conn it wraps.
+type gateConn struct {
+	net.Conn
+	release chan struct{}
+}
+
+func (c *gateConn) Write(b []byte) (int, error) {
+	<-c.release
+	return c.Conn.Write(b)
+}
+
+func TestAsyncWriterBadMessageInBatch(t *testing.T) {
+	mw, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+	mw.CompressionType = CompressNone
+	gate := &gateConn{Conn: mw.conn, release: make(chan struct{})}
+	mw.conn = gate
+	w := newAsyncWriter(mw, 16)
+
+	// the messages after the first queue up while it is being sent,
+	// and go in a single batch
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "one"})
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "two",
+		Extra: map[string]interface{}{"id": 1}})
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "three"})
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "four"})
+	close(gate.release)
+
+	if err = w.Flush(); !errors.Is(err, ErrReservedField) {
+		t.Errorf("Flush: expected ErrReservedField, got %v", err)
+	}
+	if dropped := w.DroppedMessages(); dropped != 1 {
+		t.Errorf("DroppedMessages: expected 1, got %d", dropped)
+	}
+	w.Close()
+
+	for _, expected := range []string{"one", "three", "four"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+}
+
+func TestAsyncWriterQueuesBatchesAndRaw(t *testing.T) {
+	mw, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+	mw.CompressionType = CompressNone
+	gate := &gateConn{Conn: mw.conn, release: make(chan struct{})}
+	mw.conn = gate
+	w := newAsyncWriter(mw, 16)
+
+	// nothing can be sent yet, so neither call may block on sending
+	err = w.WriteMessages([]*Message{
+		{Version: "1.1", Host: "h", Short: "one"},
+		{Version: "1.1", Host: "h", Short: "two"},
+	})
+	if err != nil {
+		t.Fatalf("WriteMessages: %s", err)
+	}
+	raw := []byte(`{"version":"1.1","host":"h","short_message":"raw"}`)
+	if err = w.WriteRaw(raw); err != nil {
+		t.Fatalf("WriteRaw: %s", err)
+	}
+	raw[0] = 'x' // the payload was copied
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "last"})
+	close(gate.release)
+
+	if err = w.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	w.Close()
+
+	for _, expected := range []string{"one", "two", "raw", "last"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+	if err = w.WriteMessages([]*Message{{Version: "1.1", Host: "h", Short: "late"}}); err != ErrWriterClosed {
+		t.Errorf("WriteMessages after Close: expected ErrWriterClosed, got %v", err)
+	}
+}
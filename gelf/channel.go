@@ -0,0 +1,245 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Messages returns a channel on which every message received by r is
+// delivered.  The first call to Messages or Errors starts a goroutine
+// doing the reading, so neither ReadMessage nor Read should be used
+// on r afterwards.  Both channels are closed once r is closed, or
+// once the reading stops as set by WithMaxMessages or
+// WithIdleTimeout.
+func (r *Reader) Messages() <-chan *Message {
+	r.loopOnce.Do(r.startLoop)
+	return r.messages
+}
+
+// Errors returns a channel on which the errors met while reading for
+// Messages are delivered.  Errors are dropped rather than stalling
+// the reading if nobody drains the channel.
+func (r *Reader) Errors() <-chan error {
+	r.loopOnce.Do(r.startLoop)
+	return r.errs
+}
+
+// DroppedMessages returns the number of messages discarded because the
+// Messages channel was full, with the OverflowDropNewest policy.
+func (r *Reader) DroppedMessages() uint64 {
+	return r.counters.overflowed.Load()
+}
+
+func (r *Reader) startLoop() {
+	r.messages = make(chan *Message, r.bufferSize)
+	r.errs = make(chan error, r.bufferSize)
+
+	if r.decodeWorkers > 0 {
+		go r.pipeline()
+	} else {
+		go r.loop()
+	}
+}
+
+func (r *Reader) loop() {
+	defer close(r.errs)
+	defer close(r.messages)
+
+	for n := 0; r.maxMessages == 0 || n < r.maxMessages; {
+		msg, err := r.loopRead()
+		if err == ErrReaderClosed {
+			return
+		}
+		if r.idleTimeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+
+		if err != nil {
+			r.sendErr(err)
+			continue
+		}
+		n++
+
+		if !r.deliver(msg) {
+			return
+		}
+	}
+
+	// nobody is going to read the rest of those
+	r.discardChunkSets()
+}
+
+// loopRead reads the next message for loop, giving up once the idle
+// timeout passes, if there is one.
+func (r *Reader) loopRead() (*Message, error) {
+	if r.idleTimeout <= 0 {
+		return r.ReadMessage()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.idleTimeout)
+	defer cancel()
+	return r.ReadMessageContext(ctx)
+}
+
+// sendErr delivers err on the Errors channel, unless it is full.
+func (r *Reader) sendErr(err error) {
+	select {
+	case r.errs <- err:
+	default:
+	}
+}
+
+// deliver delivers msg on the Messages channel, as the overflow policy
+// says.  It returns false if r was closed while waiting for room.
+func (r *Reader) deliver(msg *Message) bool {
+	if r.overflow == OverflowDropNewest {
+		select {
+		case r.messages <- msg:
+		default:
+			r.counters.overflowed.Add(1)
+		}
+		return true
+	}
+
+	select {
+	case r.messages <- msg:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// decodeJob is a message received by pipeline, for a decode worker.
+type decodeJob struct {
+	bp        *[]byte // datagram buffer to release, holding payload unless it was chunked
+	payload   []byte
+	transport Transport
+}
+
+// pipeline does what loop does with the decoding spread over
+// WithDecodeWorkers goroutines: it receives and reassembles the
+// messages, and the workers decode and deliver them, in whatever
+// order they are done.
+func (r *Reader) pipeline() {
+	defer close(r.errs)
+	defer close(r.messages)
+
+	// cancelled once the workers delivered maxMessages
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	jobs := make(chan decodeJob, r.decodeWorkers)
+	var delivered atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < r.decodeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.decodeJobs(jobs, &delivered, stop)
+		}()
+	}
+
+	closed := r.readJobs(ctx, jobs)
+	close(jobs)
+	wg.Wait()
+
+	if !closed {
+		// nobody is going to read the rest of those
+		r.discardChunkSets()
+	}
+}
+
+// readJobs hands the messages received to the decode workers, until
+// r is closed, which it reports, or the loop is to stop.
+func (r *Reader) readJobs(ctx context.Context, jobs chan<- decodeJob) (closed bool) {
+	for {
+		job, err := r.readJob(ctx)
+		switch {
+		case err == ErrReaderClosed:
+			return true
+		case err != nil && ctx.Err() != nil:
+			return false
+		case r.idleTimeout > 0 && errors.Is(err, context.DeadlineExceeded):
+			return false
+		case err != nil:
+			r.sendErr(err)
+			continue
+		}
+
+		select {
+		case jobs <- job:
+		case <-r.done:
+			r.putBuf(job.bp)
+			return true
+		}
+	}
+}
+
+// readJob receives the next message for the decode workers, giving up
+// once ctx is done or the idle timeout passes.
+func (r *Reader) readJob(ctx context.Context) (decodeJob, error) {
+	job := decodeJob{bp: r.getBuf()}
+	read := func() (err error) {
+		r.readMu.Lock()
+		defer r.readMu.Unlock()
+		job.payload, _, err = r.readPayload(*job.bp, &job.transport)
+		return err
+	}
+
+	var err error
+	switch {
+	case r.idleTimeout > 0:
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.idleTimeout)
+		defer cancel()
+		err = r.readContext(ctx, read)
+	case r.maxMessages > 0:
+		err = r.readContext(ctx, read)
+	default:
+		// nothing to interrupt the read for
+		err = read()
+	}
+	if err != nil {
+		r.putBuf(job.bp)
+		return decodeJob{}, err
+	}
+	return job, nil
+}
+
+// decodeJobs decodes and delivers the messages of jobs until it is
+// closed, calling stop once maxMessages were delivered; any decoded
+// afterwards are discarded.
+func (r *Reader) decodeJobs(jobs <-chan decodeJob, delivered *atomic.Int64, stop func()) {
+	for job := range jobs {
+		mapped, err := r.decodePayload(job.payload, nil, &job.transport)
+		r.putBuf(job.bp)
+		if err == errHandled || err == nil && r.skipLevel(mapped) {
+			continue
+		}
+		var msg *Message
+		if err == nil {
+			msg, err = r.toMessage(nil, mapped, job.transport)
+		}
+		if err != nil {
+			r.sendErr(err)
+			continue
+		}
+
+		if r.maxMessages > 0 {
+			n := delivered.Add(1)
+			if n > int64(r.maxMessages) {
+				continue
+			}
+			if n == int64(r.maxMessages) {
+				stop()
+			}
+		}
+		r.deliver(msg)
+	}
+}
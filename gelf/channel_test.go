@@ -0,0 +1,202 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderMessages(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithMessageBuffer(1, OverflowBlock))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+
+	sendRaw(t, r.Addr(),
+		[]byte(`{"version":"1.1","host":"h","short_message":"one"}`),
+		[]byte("not json"),
+		[]byte(`{"version":"1.1","host":"h","short_message":"two"}`))
+
+	msgs, errs := r.Messages(), r.Errors()
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case msg := <-msgs:
+			if msg.Short != expected {
+				t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", expected)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("expected a decoding error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for an error")
+	}
+
+	r.Close()
+	for range msgs {
+	}
+	for range errs {
+	}
+}
+
+func TestReaderMessagesDropNewest(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithMessageBuffer(1, OverflowDropNewest))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	msgs := r.Messages()
+	sendRaw(t, r.Addr(),
+		[]byte(`{"version":"1.1","host":"h","short_message":"kept"}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"dropped"}`))
+
+	deadline := time.Now().Add(time.Second)
+	for r.DroppedMessages() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := r.DroppedMessages(); n != 1 {
+		t.Fatalf("DroppedMessages: expected 1, got %d", n)
+	}
+
+	if msg := <-msgs; msg.Short != "kept" {
+		t.Errorf("msg.Short: expected kept, got %s", msg.Short)
+	}
+}
+
+func TestWithMessageBufferInvalid(t *testing.T) {
+	if _, err := NewReader("127.0.0.1:0", WithMessageBuffer(-1, OverflowBlock)); err == nil {
+		t.Errorf("expected an error for a negative buffer size")
+	}
+}
+
+func TestReaderMessagesAutoStop(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+	r.maxMessages = 2
+
+	for _, short := range []string{"one", "two", "three"} {
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short})
+	}
+	var got []string
+	for msg := range r.Messages() {
+		got = append(got, msg.Short)
+	}
+	if len(got) != 2 || got[1] != "two" {
+		t.Errorf("expected messages one and two, got %q", got)
+	}
+
+	// an idle reader stops, discarding the message it was reassembling
+	r, err = newReader(newMemConn(), []ReaderOption{WithIdleTimeout(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+	defer r.Close()
+	r.conn.Write(chunk(1, 0, 2, `{"version":"1.1",`))
+
+	start := time.Now()
+	select {
+	case _, ok := <-r.Messages():
+		if ok {
+			t.Errorf("got a message from an incomplete one")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reader didn't stop after its idle timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("reader stopped after %s, before its idle timeout", elapsed)
+	}
+	if n := len(r.chunkSets); n != 0 {
+		t.Errorf("expected no chunk set left, got %d", n)
+	}
+	if incomplete := r.Stats().Incomplete; incomplete != 1 {
+		t.Errorf("Incomplete: expected 1, got %d", incomplete)
+	}
+}
+
+func TestReaderDecodeWorkers(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+	if err = WithDecodeWorkers(0)(r); err == nil {
+		t.Errorf("WithDecodeWorkers accepted 0 workers")
+	}
+	if err = WithDecodeWorkers(4)(r); err != nil {
+		t.Fatalf("WithDecodeWorkers: %s", err)
+	}
+	r.idleTimeout = 200 * time.Millisecond
+
+	// some of them chunked, and one that doesn't decode
+	w.SetChunkSize(200)
+	w.CompressionType = CompressNone
+	for i := 0; i < 100; i++ {
+		short := fmt.Sprint(i)
+		if i%10 == 0 {
+			short += strings.Repeat(" padding", 100)
+		}
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short})
+	}
+	r.conn.Write([]byte("not json"))
+
+	seen := make(map[string]bool)
+	for msg := range r.Messages() {
+		seen[strings.Fields(msg.Short)[0]] = true
+	}
+	if len(seen) != 100 {
+		t.Errorf("expected 100 distinct messages, got %d", len(seen))
+	}
+	if err := <-r.Errors(); err == nil {
+		t.Errorf("expected a decoding error")
+	}
+	if stats := r.Stats(); stats.Reassembled != 10 {
+		t.Errorf("Reassembled: expected 10, got %d", stats.Reassembled)
+	}
+}
+
+func TestReaderDecodeWorkersMaxMessages(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+	r.decodeWorkers = 3
+	r.maxMessages = 5
+
+	for i := 0; i < 20; i++ {
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"})
+	}
+
+	n := 0
+	done := time.After(5 * time.Second)
+	for msgs := r.Messages(); msgs != nil; {
+		select {
+		case _, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+			n++
+		case <-done:
+			t.Fatalf("Messages not closed after 5 messages")
+		}
+	}
+	if n != 5 {
+		t.Errorf("expected 5 messages, got %d", n)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ChunkHeader is what the header of a chunk says about it.
+type ChunkHeader struct {
+	ID    []byte // of the message the chunk belongs to
+	Seq   int    // of the chunk, from 0
+	Total int    // number of chunks of the message
+}
+
+// ChunkHeaderParser tells chunks apart from whole messages, and parses
+// their headers.  The default one reads the GELF chunk header: the
+// magic bytes 0x1e 0x0f, an 8-byte message id, then a byte each for
+// the sequence number and the total; WithChunkHeaderParser replaces it
+// to read chunks from senders using another header.
+type ChunkHeaderParser interface {
+	// IsChunk reports whether datagram is a chunk, rather than a
+	// whole message.
+	IsChunk(datagram []byte) bool
+	// ParseChunkHeader returns the header of chunk and its payload,
+	// both of which may refer to chunk, or an error if the header is
+	// malformed.  The Reader checks that Seq is below Total, and
+	// that Total is allowed by WithMaxChunks.
+	ParseChunkHeader(chunk []byte) (ChunkHeader, []byte, error)
+}
+
+type gelfChunkHeader struct{}
+
+func (gelfChunkHeader) IsChunk(datagram []byte) bool {
+	return bytes.HasPrefix(datagram, magicChunked)
+}
+
+func (gelfChunkHeader) ParseChunkHeader(chunk []byte) (ChunkHeader, []byte, error) {
+	if len(chunk) < chunkedHeaderLen {
+		return ChunkHeader{}, nil, ErrInvalidChunkHeader
+	}
+	h := ChunkHeader{
+		ID:    chunk[2 : 2+8],
+		Seq:   int(chunk[2+8]),
+		Total: int(chunk[2+8+1]),
+	}
+	return h, chunk[chunkedHeaderLen:], nil
+}
+
+// WithChunkHeaderParser makes the reader recognize and parse chunks
+// with p, instead of by the GELF chunk header.
+func WithChunkHeaderParser(p ChunkHeaderParser) ReaderOption {
+	return func(r *Reader) error {
+		if p == nil {
+			return errors.New("nil chunk header parser")
+		}
+		r.chunkParser = p
+		return nil
+	}
+}
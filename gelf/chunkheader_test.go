@@ -0,0 +1,82 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// wideChunkHeader parses a variant of the GELF chunk header, with
+// magic bytes 0x1e 0x10 and 2-byte sequence numbers and totals.
+type wideChunkHeader struct{}
+
+var magicWide = []byte{0x1e, 0x10}
+
+func (wideChunkHeader) IsChunk(datagram []byte) bool {
+	return bytes.HasPrefix(datagram, magicWide)
+}
+
+func (wideChunkHeader) ParseChunkHeader(chunk []byte) (ChunkHeader, []byte, error) {
+	if len(chunk) < 2+8+4 {
+		return ChunkHeader{}, nil, ErrInvalidChunkHeader
+	}
+	h := ChunkHeader{
+		ID:    chunk[2 : 2+8],
+		Seq:   int(binary.BigEndian.Uint16(chunk[2+8:])),
+		Total: int(binary.BigEndian.Uint16(chunk[2+8+2:])),
+	}
+	return h, chunk[2+8+4:], nil
+}
+
+func wideChunk(seq, total uint16, data string) []byte {
+	b := append([]byte{}, magicWide...)
+	b = append(b, "widechnk"...)
+	b = binary.BigEndian.AppendUint16(b, seq)
+	b = binary.BigEndian.AppendUint16(b, total)
+	return append(b, data...)
+}
+
+func TestChunkHeaderParser(t *testing.T) {
+	json := `{"version":"1.1","host":"h","short_message":"wide"}`
+	conn := &chunkedReplayConn{chunks: [][]byte{
+		wideChunk(1, 3, json[20:40]),
+		wideChunk(0, 3, json[:20]),
+		wideChunk(2, 3, json[40:]),
+	}}
+	r, err := newReader(conn, []ReaderOption{WithChunkHeaderParser(wideChunkHeader{})})
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "wide" {
+		t.Errorf("msg.Short: expected wide, got %q", msg.Short)
+	}
+	if tr := msg.Transport; !tr.Chunked || tr.ChunkCount != 3 {
+		t.Errorf("Transport: expected 3 chunks, got %+v", tr)
+	}
+
+	// the reader checks the sequence number itself
+	conn.chunks, conn.next = [][]byte{wideChunk(3, 3, json)}, 0
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrInvalidChunkHeader) {
+		t.Errorf("chunk past the total: expected ErrInvalidChunkHeader, got %v", err)
+	}
+
+	// standard chunks are now taken for whole messages
+	conn.chunks, conn.next = [][]byte{chunk(1, 0, 1, json)}, 0
+	if _, err = r.ReadMessage(); err == nil {
+		t.Errorf("GELF chunk: expected a decoding error")
+	}
+
+	if _, err = NewReader("127.0.0.1:0", WithChunkHeaderParser(nil)); err == nil {
+		t.Errorf("expected an error for a nil parser")
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// JSONCodec encodes and decodes the JSON of messages, so that a faster
+// package than encoding/json, such as jsoniter, can be plugged into a
+// Reader or Writer with SetJSONCodec.  Marshal must honor the
+// encoding/json struct tags.  Unmarshal only ever decodes into a
+// *map[string]interface{}, and should make numbers json.Number, as a
+// json.Decoder using UseNumber does: float64 loses precision on large
+// integers.
+type JSONCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// stdCodec is the default JSONCodec, using encoding/json.
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
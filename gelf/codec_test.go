@@ -0,0 +1,162 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// countingCodec is encoding/json, counting the calls.
+type countingCodec struct {
+	stdCodec
+	marshals, unmarshals int
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.marshals++
+	return c.stdCodec.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.unmarshals++
+	return c.stdCodec.Unmarshal(data, v)
+}
+
+// plainCodec decodes with json.Unmarshal, making numbers float64.
+type plainCodec struct{}
+
+func (plainCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (plainCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestWriterJSONCodec(t *testing.T) {
+	conn := new(recordingConn)
+	w := &Writer{conn: conn, CompressionType: CompressNone}
+	codec := new(countingCodec)
+	w.SetJSONCodec(codec)
+
+	m := &Message{
+		Version: "1.1",
+		Host:    "h",
+		Short:   "short",
+		Extra:   map[string]interface{}{"_file": "1234"},
+	}
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if codec.marshals != 2 {
+		t.Errorf("expected 2 calls to Marshal, got %d", codec.marshals)
+	}
+
+	var got Message
+	if err := got.UnmarshalJSON(conn.last); err != nil {
+		t.Fatalf("UnmarshalJSON(%s): %s", conn.last, err)
+	}
+	if got.Short != "short" || got.Extra["file"] != "1234" {
+		t.Errorf("unexpected message %s", conn.last)
+	}
+
+	w.SetJSONCodec(nil)
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if codec.marshals != 2 {
+		t.Errorf("codec used after SetJSONCodec(nil)")
+	}
+}
+
+func TestReaderJSONCodec(t *testing.T) {
+	r, err := newReader(&replayConn{datagram: []byte(
+		`{"version":"1.1","host":"h","short_message":"short","_n":12345678901234567890}`)}, nil)
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+
+	codec := new(countingCodec)
+	r.SetJSONCodec(codec)
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if codec.unmarshals != 1 {
+		t.Errorf("expected 1 call to Unmarshal, got %d", codec.unmarshals)
+	}
+	if msg.Short != "short" {
+		t.Errorf("msg.Short: expected short, got %s", msg.Short)
+	}
+	if n, ok := msg.Extra["n"].(json.Number); !ok || n != "12345678901234567890" {
+		t.Errorf("_n: expected json.Number 12345678901234567890, got %#v", msg.Extra["n"])
+	}
+
+	r.SetJSONCodec(plainCodec{})
+	if msg, err = r.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if _, ok := msg.Extra["n"].(float64); !ok {
+		t.Errorf("_n: expected float64 from plainCodec, got %#v", msg.Extra["n"])
+	}
+}
+
+func BenchmarkJSONCodec(b *testing.B) {
+	m := &Message{
+		Version:  "1.1",
+		Host:     "bench",
+		Short:    "short message",
+		Full:     "full message",
+		TimeUnix: 1700000000.123,
+		Level:    6,
+		Extra: map[string]interface{}{
+			"_file":    "main.go",
+			"_line":    42,
+			"_request": "GET /index.html",
+			"_took":    0.0123,
+		},
+	}
+	datagram, err := m.MarshalJSON()
+	if err != nil {
+		b.Fatalf("MarshalJSON: %s", err)
+	}
+
+	codecs := []struct {
+		name  string
+		codec JSONCodec
+	}{
+		{"stdlib", nil},
+		{"injected", plainCodec{}},
+	}
+	for _, c := range codecs {
+		b.Run(c.name+"/write", func(b *testing.B) {
+			w := &Writer{conn: new(countingConn), CompressionType: CompressNone}
+			w.SetJSONCodec(c.codec)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteMessage(m); err != nil {
+					b.Fatalf("WriteMessage: %s", err)
+				}
+			}
+		})
+		b.Run(c.name+"/read", func(b *testing.B) {
+			r, err := newReader(&replayConn{datagram: datagram}, nil)
+			if err != nil {
+				b.Fatalf("newReader: %s", err)
+			}
+			r.SetJSONCodec(c.codec)
+
+			var msg Message
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := r.ReadMessageInto(&msg); err != nil {
+					b.Fatalf("ReadMessageInto: %s", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Largest message accepted once decompressed, unless changed with
+// SetMaxDecompressedSize.
+const defaultMaxDecompressedSize = 16 << 20
+
+// decoder turns the payload of a message, reassembled from its
+// chunks if it was chunked, into the JSON object it encodes.
+type decoder struct {
+	maxDecompressedSize int64
+	decoderFunc         func(io.Reader) *json.Decoder
+	codec               JSONCodec // takes precedence over decoderFunc
+	decompressors       []Decompressor
+	rawDeflate          bool   // retry undecodable messages as raw DEFLATE
+	zlibDict            []byte // preset dictionary of zlib messages
+}
+
+// Decompressor adds support for a compression format that isn't
+// built in, registered on a Reader with WithDecompressor.  If it has a
+// Name() string method, its result names the format in
+// Transport.Compression.
+type Decompressor interface {
+	// Detect reports whether payload, a whole message once
+	// reassembled, is compressed in this format.
+	Detect(payload []byte) bool
+	// NewReader returns a reader of what r decompresses to.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+type zstdDecompressor func(io.Reader) (io.Reader, error)
+
+// NewZstdDecompressor returns a Decompressor for zstd, which newer
+// GELF senders may use.  Frames are recognized by their magic number,
+// and decompressed by newReader, which this package leaves to a zstd
+// library so as not to depend on one.  For instance, with
+// github.com/klauspost/compress/zstd:
+//
+//	gelf.NewZstdDecompressor(func(r io.Reader) (io.Reader, error) {
+//		return zstd.NewReader(r)
+//	})
+func NewZstdDecompressor(newReader func(io.Reader) (io.Reader, error)) Decompressor {
+	return zstdDecompressor(newReader)
+}
+
+// Name identifies the format in Transport.Compression.
+func (z zstdDecompressor) Name() string {
+	return "zstd"
+}
+
+func (z zstdDecompressor) Detect(payload []byte) bool {
+	return bytes.HasPrefix(payload, magicZstd)
+}
+
+func (z zstdDecompressor) NewReader(r io.Reader) (io.Reader, error) {
+	return z(r)
+}
+
+// decompressorName returns the name of d's format, which it gives
+// with a Name method if it has one.
+func decompressorName(d Decompressor) string {
+	if n, ok := d.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", d)
+}
+
+func newDecoder() decoder {
+	return decoder{maxDecompressedSize: defaultMaxDecompressedSize}
+}
+
+func (d *decoder) decode(cBuf []byte) (map[string]interface{}, error) {
+	msg, _, err := d.decodeRaw(cBuf, nil)
+	return msg, err
+}
+
+// decodeRaw is like decode, but if raw isn't nil, it also sets it to
+// the decompressed JSON, in a buffer of its own.  It also returns the
+// name of the compression the message used, as in
+// Transport.Compression.
+func (d *decoder) decodeRaw(cBuf []byte, raw *[]byte) (msg map[string]interface{}, compression string, err error) {
+	var cReader io.Reader
+
+	if len(cBuf) < 2 {
+		return nil, "", fmt.Errorf("%w: message too short (%d bytes)", ErrJSONDecode, len(cBuf))
+	}
+	cHead := cBuf[:2]
+
+	// Decompressors are tried before zlib, as a zlib header is only
+	// recognized by a checksum that anything else may happen to pass.
+	var custom Decompressor
+	for _, dc := range d.decompressors {
+		if dc.Detect(cBuf) {
+			custom = dc
+			break
+		}
+	}
+
+	// the data we get from the wire is compressed
+	if bytes.Equal(cHead, magicGzip) {
+		compression = "gzip"
+		cReader, err = gzip.NewReader(bytes.NewReader(cBuf))
+	} else if custom != nil {
+		compression = decompressorName(custom)
+		cReader, err = custom.NewReader(bytes.NewReader(cBuf))
+	} else if cHead[0] == magicZlib[0] &&
+		(int(cHead[0])*256+int(cHead[1]))%31 == 0 {
+		// zlib is slightly more complicated, but correct
+		var inflated []byte
+		if inflated, err = d.inflateZlib(cBuf); err == ErrMessageTooLarge {
+			return nil, "", err
+		} else if err == zlib.ErrDictionary {
+			return nil, "", fmt.Errorf("%w: zlib message compressed with another dictionary (see SetZlibDictionary)", ErrDecompress)
+		} else if err != nil {
+			// the header check is only a checksum, which the
+			// start of an uncompressed message may pass as well
+			cReader, err = bytes.NewReader(cBuf), nil
+			compression = "none"
+		} else {
+			cReader = bytes.NewReader(inflated)
+			compression = "zlib"
+		}
+	} else {
+		// compliance with https://github.com/Graylog2/graylog2-server
+		// treating all messages as uncompressed if  they are not gzip, zlib or
+		// chunked
+		cReader = bytes.NewReader(cBuf)
+		compression = "none"
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: NewReader: %w", ErrDecompress, err)
+	}
+	if _, plain := cReader.(*bytes.Reader); !plain {
+		cReader = decompressReader{cReader}
+	}
+
+	// some senders, .NET ones among them, start the JSON with a UTF-8
+	// byte order mark, which json.Decoder rejects
+	if cReader, err = skipBOM(cReader); err != nil {
+		var derr decompressError
+		if errors.As(err, &derr) {
+			err = derr.err
+		}
+		return nil, "", fmt.Errorf("%w: %w", ErrDecompress, err)
+	}
+
+	// guard against tiny datagrams inflating to huge messages
+	var limited *io.LimitedReader
+	if d.maxDecompressedSize > 0 {
+		limited = &io.LimitedReader{R: cReader, N: d.maxDecompressedSize + 1}
+		cReader = limited
+	}
+
+	var b []byte
+	if raw != nil || d.codec != nil {
+		b, err = ioutil.ReadAll(cReader)
+		if limited != nil && limited.N <= 0 {
+			return nil, "", ErrMessageTooLarge
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", ErrDecompress, err)
+		}
+		if raw != nil {
+			*raw = b
+		}
+		cReader = bytes.NewReader(b)
+	}
+
+	if d.codec != nil {
+		err = d.codec.Unmarshal(b, &msg)
+	} else {
+		var dec *json.Decoder
+		if d.decoderFunc != nil {
+			dec = d.decoderFunc(cReader)
+		} else {
+			// keep numbers as json.Number, so that large integers in
+			// extra fields don't lose precision by going through float64
+			dec = json.NewDecoder(cReader)
+			dec.UseNumber()
+		}
+		err = dec.Decode(&msg)
+	}
+	if limited != nil && limited.N <= 0 {
+		return nil, "", ErrMessageTooLarge
+	}
+	var derr decompressError
+	if errors.As(err, &derr) {
+		return nil, "", fmt.Errorf("%w: %w", ErrDecompress, derr.err)
+	}
+	if err != nil {
+		if compression == "none" && d.rawDeflate {
+			if msg, err := d.decodeRawDeflate(cBuf, raw); err == nil || err == ErrMessageTooLarge {
+				return msg, "deflate", err
+			}
+		}
+		return nil, "", fmt.Errorf("%w: json.Unmarshal: %w", ErrJSONDecode, err)
+	}
+
+	return msg, compression, nil
+}
+
+// decodeRawDeflate decodes cBuf as DEFLATE data without a zlib header,
+// which has no magic bytes to be recognized by.
+func (d *decoder) decodeRawDeflate(cBuf []byte, raw *[]byte) (map[string]interface{}, error) {
+	inflated, err := d.inflate(flate.NewReader(bytes.NewReader(cBuf)))
+	if err != nil {
+		return nil, err
+	}
+
+	plain := *d
+	plain.rawDeflate = false
+	msg, _, err := plain.decodeRaw(inflated, raw)
+	return msg, err
+}
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// skipBOM returns a reader of what r reads, less a leading UTF-8 byte
+// order mark.
+func skipBOM(r io.Reader) (io.Reader, error) {
+	var head [3]byte
+	n, err := io.ReadFull(r, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n == len(head) && bytes.Equal(head[:], utf8BOM) {
+		return r, nil
+	}
+
+	if br, ok := r.(*bytes.Reader); ok {
+		br.Seek(int64(-n), io.SeekCurrent)
+		return br, nil
+	}
+	return io.MultiReader(bytes.NewReader(head[:n]), r), nil
+}
+
+// decompressReader tells the errors of the decompressing reader it
+// wraps apart from those of the JSON decoder reading from it.
+type decompressReader struct {
+	r io.Reader
+}
+
+type decompressError struct {
+	err error
+}
+
+func (e decompressError) Error() string {
+	return e.err.Error()
+}
+
+func (e decompressError) Unwrap() error {
+	return e.err
+}
+
+func (d decompressReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = decompressError{err}
+	}
+	return n, err
+}
+
+// inflateZlib decompresses the whole zlib stream in cBuf, so that
+// the checksum ending it is verified.
+func (d *decoder) inflateZlib(cBuf []byte) ([]byte, error) {
+	var zr io.ReadCloser
+	var err error
+	if d.zlibDict != nil {
+		zr, err = zlib.NewReaderDict(bytes.NewReader(cBuf), d.zlibDict)
+	} else {
+		zr, err = zlib.NewReader(bytes.NewReader(cBuf))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.inflate(zr)
+}
+
+// inflate reads all of zr, up to the maximum decompressed size.
+func (d *decoder) inflate(zr io.ReadCloser) ([]byte, error) {
+	var r io.Reader = zr
+	if d.maxDecompressedSize > 0 {
+		r = io.LimitReader(zr, d.maxDecompressedSize+1)
+	}
+	inflated, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if d.maxDecompressedSize > 0 && int64(len(inflated)) > d.maxDecompressedSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	return inflated, zr.Close()
+}
+
+// DecodeMessage decodes a GELF message from everything read from r,
+// decompressing it like a Reader would.  If the data starts with the
+// chunked magic bytes, it must be the concatenation of all the chunk
+// datagrams of a single message, in any order.
+func DecodeMessage(r io.Reader) (*Message, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, magicChunked) {
+		if data, err = joinChunks(data); err != nil {
+			return nil, err
+		}
+	}
+
+	d := newDecoder()
+	mapped, err := d.decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(Message)
+	msg.fromMap(mapped)
+
+	return msg, nil
+}
+
+// joinChunks reassembles the payload of a message from its chunk
+// datagrams laid end to end.  Chunks don't record their length, so
+// each one is taken to end where the next chunk header, made of the
+// magic bytes and the message id, starts.
+func joinChunks(data []byte) ([]byte, error) {
+	if len(data) < chunkedHeaderLen {
+		return nil, ErrInvalidChunkHeader
+	}
+	sep := append([]byte(nil), data[:2+8]...)
+
+	var chunks [][]byte
+	for len(data) > 0 {
+		if len(data) < chunkedHeaderLen || !bytes.HasPrefix(data, sep) {
+			return nil, ErrInvalidChunkHeader
+		}
+		seq, total := data[2+8], data[2+8+1]
+		if chunks == nil {
+			chunks = make([][]byte, total)
+		}
+		if int(total) != len(chunks) || seq >= total {
+			return nil, ErrInvalidChunkHeader
+		}
+
+		end := len(data)
+		if i := bytes.Index(data[chunkedHeaderLen:], sep); i >= 0 {
+			end = chunkedHeaderLen + i
+		}
+		if chunks[seq] == nil {
+			chunks[seq] = data[chunkedHeaderLen:end]
+		}
+		data = data[end:]
+	}
+
+	for i := range chunks {
+		if chunks[i] == nil {
+			return nil, fmt.Errorf("%w: chunk %d of %d", ErrMissingChunk, i, len(chunks))
+		}
+	}
+
+	return bytes.Join(chunks, nil), nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	plain := `{"version":"1.1","host":"h","short_message":"decoded","_n":1}`
+
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(plain))
+	zw.Close()
+	z := zBuf.String()
+
+	var chunked []byte
+	chunked = append(chunked, chunk('a', 1, 3, z[10:20])...)
+	chunked = append(chunked, chunk('a', 0, 3, z[:10])...)
+	chunked = append(chunked, chunk('a', 2, 3, z[20:])...)
+
+	for name, data := range map[string]string{
+		"uncompressed": plain,
+		"gzip":         z,
+		"chunked":      string(chunked),
+	} {
+		msg, err := DecodeMessage(strings.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: DecodeMessage: %s", name, err)
+			continue
+		}
+		if msg.Short != "decoded" || msg.Extra["n"] == nil {
+			t.Errorf("%s: unexpected message %+v", name, msg)
+		}
+	}
+
+	if _, err := DecodeMessage(bytes.NewReader(chunked[:len(chunked)-len(z[20:])-chunkedHeaderLen])); !errors.Is(err, ErrMissingChunk) {
+		t.Errorf("expected ErrMissingChunk for a missing chunk, got %v", err)
+	}
+}
+
+func TestDecodeBOM(t *testing.T) {
+	plain := "\xef\xbb\xbf" + `{"version":"1.1","host":"h","short_message":"bom"}`
+
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(plain))
+	zw.Close()
+
+	for name, data := range map[string]string{
+		"uncompressed": plain,
+		"gzip":         zBuf.String(),
+		"whitespace":   " \n" + plain[3:],
+		"short":        "\xef\xbb",
+	} {
+		msg, err := DecodeMessage(strings.NewReader(data))
+		if name == "short" {
+			if !errors.Is(err, ErrJSONDecode) {
+				t.Errorf("%s: expected ErrJSONDecode, got %v", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: DecodeMessage: %s", name, err)
+			continue
+		}
+		if msg.Short != "bom" {
+			t.Errorf("%s: msg.Short: expected bom, got %s", name, msg.Short)
+		}
+	}
+}
+
+// zstdRaw returns a zstd frame storing b in a single raw block, so
+// that tests don't need a zstd library.
+func zstdRaw(b []byte) []byte {
+	if len(b) > 255 {
+		panic("zstdRaw: payload too large")
+	}
+	// single segment frame, with a one byte content size
+	frame := append([]byte{}, magicZstd...)
+	frame = append(frame, 0x20, byte(len(b)))
+	// last block, raw, of len(b) bytes
+	h := len(b)<<3 | 1
+	frame = append(frame, byte(h), byte(h>>8), byte(h>>16))
+
+	return append(frame, b...)
+}
+
+// unzstdRaw reads back the frames written by zstdRaw, standing in for
+// a zstd library's decoder.
+func unzstdRaw(r io.Reader) (io.Reader, error) {
+	frame, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) < 9 || !bytes.HasPrefix(frame, magicZstd) || frame[4] != 0x20 {
+		return nil, errors.New("unsupported zstd frame")
+	}
+	h := int(frame[6]) | int(frame[7])<<8 | int(frame[8])<<16
+	if h&7 != 1 || len(frame) != 9+h>>3 {
+		return nil, errors.New("unsupported zstd block")
+	}
+
+	return bytes.NewReader(frame[9:]), nil
+}
+
+func TestReadZstd(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithDecompressor(NewZstdDecompressor(unzstdRaw)))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	z := zstdRaw([]byte(`{"version":"1.1","host":"h","short_message":"zstd"}`))
+	sendRaw(t, r.Addr(), z, chunk('z', 0, 2, string(z[:20])), chunk('z', 1, 2, string(z[20:])))
+
+	for i := 0; i < 2; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != "zstd" {
+			t.Errorf("msg.Short: expected zstd, got %s", msg.Short)
+		}
+	}
+}
+
+func TestReadRawDeflate(t *testing.T) {
+	var zBuf bytes.Buffer
+	zw, _ := flate.NewWriter(&zBuf, flate.BestSpeed)
+	zw.Write([]byte(`{"version":"1.1","host":"h","short_message":"deflate"}`))
+	zw.Close()
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	sendRaw(t, r.Addr(), zBuf.Bytes())
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrJSONDecode) {
+		t.Errorf("without WithRawDeflate: expected ErrJSONDecode, got %v", err)
+	}
+
+	r, err = NewReader("127.0.0.1:0", WithRawDeflate())
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	sendRaw(t, r.Addr(), zBuf.Bytes(), []byte(`{"version":"1.1","host":"h","short_message":"plain"}`), []byte("not json"))
+
+	for _, expected := range []string{"deflate", "plain"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+		if expected == "deflate" && msg.Transport.Compression != "deflate" {
+			t.Errorf("Transport.Compression: expected deflate, got %s", msg.Transport.Compression)
+		}
+	}
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrJSONDecode) {
+		t.Errorf("invalid message: expected ErrJSONDecode, got %v", err)
+	}
+}
+
+// tests that a message passing the zlib header check without being
+// zlib is decoded as uncompressed
+func TestDecodeZlibFalsePositive(t *testing.T) {
+	for _, payload := range []string{"x\x01{}", "x^{}", "x}{}"} {
+		var seen []byte
+		d := newDecoder()
+		d.decoderFunc = func(r io.Reader) *json.Decoder {
+			seen, _ = ioutil.ReadAll(r)
+			return json.NewDecoder(bytes.NewReader(bytes.TrimLeft(seen, "x\x01^}")))
+		}
+
+		if _, err := d.decode([]byte(payload)); err != nil {
+			t.Errorf("%q: decode: %s", payload, err)
+		}
+		if string(seen) != payload {
+			t.Errorf("%q: expected the payload to be decoded as is, got %q", payload, seen)
+		}
+	}
+
+	// real zlib still works
+	var zBuf bytes.Buffer
+	zw := zlib.NewWriter(&zBuf)
+	zw.Write([]byte(`{"short_message":"zlib"}`))
+	zw.Close()
+	msg, err := DecodeMessage(&zBuf)
+	if err != nil {
+		t.Fatalf("DecodeMessage: %s", err)
+	}
+	if msg.Short != "zlib" {
+		t.Errorf("msg.Short: expected zlib, got %s", msg.Short)
+	}
+}
+
+func TestDecodeErrorKinds(t *testing.T) {
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(`{"version":"1.1","host":"h","short_message":"gzipped"}`))
+	zw.Close()
+	gzipped := zBuf.Bytes()
+
+	for _, tc := range []struct {
+		name     string
+		payload  []byte
+		expected error
+	}{
+		{"bad gzip header", append(append([]byte(nil), magicGzip...), 0, 0, 0), ErrDecompress},
+		{"truncated gzip", gzipped[:len(gzipped)/2], ErrDecompress},
+		{"invalid JSON", []byte(`{"version":`), ErrJSONDecode},
+		{"not an object", []byte(`[1, 2]`), ErrJSONDecode},
+	} {
+		_, err := DecodeMessage(bytes.NewReader(tc.payload))
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// extra returns the additional field key, with or without its leading
+// underscore: decoded messages have their fields without one, while
+// messages built to be sent may have it.
+func (m *Message) extra(key string) (interface{}, bool) {
+	if v, ok := m.Extra[key]; ok {
+		return v, true
+	}
+	if strings.HasPrefix(key, "_") {
+		v, ok := m.Extra[key[1:]]
+		return v, ok
+	}
+	v, ok := m.Extra["_"+key]
+	return v, ok
+}
+
+// SortedExtraKeys returns the names of m's additional fields, in
+// sorted order.
+func (m *Message) SortedExtraKeys() []string {
+	keys := make([]string, 0, len(m.Extra))
+	for k := range m.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RangeExtras calls f with every additional field of m, in sorted key
+// order, until f returns false.
+func (m *Message) RangeExtras(f func(key string, val interface{}) bool) {
+	for _, k := range m.SortedExtraKeys() {
+		if !f(k, m.Extra[k]) {
+			return
+		}
+	}
+}
+
+// ExtraKeyPolicy decides what is done with additional fields whose
+// names have characters GELF doesn't allow: only letters, digits,
+// underscores, dashes and dots are.
+type ExtraKeyPolicy int
+
+const (
+	// ExtraKeyKeep leaves such fields alone, for the server to
+	// reject or mangle.
+	ExtraKeyKeep ExtraKeyPolicy = iota
+	// ExtraKeyReplace replaces every character not allowed with an
+	// underscore.
+	ExtraKeyReplace
+	// ExtraKeyDrop removes such fields.
+	ExtraKeyDrop
+)
+
+// validExtraKey reports whether key is a legal GELF field name.
+func validExtraKey(key string) bool {
+	return key != "" && fieldName(key) == key
+}
+
+// NormalizeExtraKeys applies policy to the additional fields of m
+// whose names aren't legal GELF field names.  With ExtraKeyReplace, a
+// name that becomes that of another field is given a "_2", "_3"...
+// suffix, renamed fields being numbered in sorted order of their
+// original names.  Fields with an empty name are dropped either way.
+func (m *Message) NormalizeExtraKeys(policy ExtraKeyPolicy) {
+	if policy == ExtraKeyKeep {
+		return
+	}
+
+	var illegal []string
+	for k := range m.Extra {
+		if !validExtraKey(k) {
+			illegal = append(illegal, k)
+		}
+	}
+	sort.Strings(illegal)
+
+	for _, k := range illegal {
+		v := m.Extra[k]
+		delete(m.Extra, k)
+		if policy != ExtraKeyReplace || k == "" {
+			continue
+		}
+
+		name := fieldName(k)
+		for i := 2; ; i++ {
+			if _, taken := m.Extra[name]; !taken {
+				break
+			}
+			name = fmt.Sprintf("%s_%d", fieldName(k), i)
+		}
+		m.Extra[name] = v
+	}
+}
+
+// ExtraString returns the additional field key as a string.  Numbers
+// and booleans are formatted; a null or missing field returns false.
+func (m *Message) ExtraString(key string) (string, bool) {
+	v, _ := m.extra(key)
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	if i, ok := intValue(v); ok {
+		return strconv.FormatInt(i, 10), true
+	}
+	return "", false
+}
+
+// ExtraFloat returns the additional field key as a float64.  Strings
+// holding a number are parsed; anything else but a number returns
+// false.
+func (m *Message) ExtraFloat(key string) (float64, bool) {
+	v, _ := m.extra(key)
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	if i, ok := intValue(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// ExtraInt returns the additional field key as an int64.  Floating
+// point numbers are converted only if they are whole and in range, and
+// strings holding such a number are parsed.
+func (m *Message) ExtraInt(key string) (int64, bool) {
+	v, _ := m.extra(key)
+	switch v := v.(type) {
+	case json.Number:
+		return numberToInt(v)
+	case float64:
+		return floatToInt(v)
+	case float32:
+		return floatToInt(float64(v))
+	case string:
+		return numberToInt(json.Number(strings.TrimSpace(v)))
+	}
+	return intValue(v)
+}
+
+// DecodeExtras sets the fields of the struct v points to from m's
+// additional fields.  A struct field is named by its gelf tag, as in
+// `gelf:"user_id"`, or else its json tag, or else its own name, and
+// receives the additional field of that name, with or without its
+// leading underscore.  Values are converted as ExtraString, ExtraInt
+// and ExtraFloat do; integers that overflow the field are an error.
+// An interface{} field gets the value as it is.  Fields tagged "-",
+// unexported ones, and those whose additional field is missing or null
+// are left alone.  Embedded structs' fields are decoded as if they
+// were v's.
+func (m *Message) DecodeExtras(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("DecodeExtras: need a non-nil struct pointer, not %T", v)
+	}
+	return m.decodeExtras(rv.Elem())
+}
+
+func (m *Message) decodeExtras(sv reflect.Value) error {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		name := extraFieldName(f)
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && name == f.Name {
+			if err := m.decodeExtras(sv.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if val, ok := m.extra(name); !ok || val == nil {
+			continue
+		}
+		if err := m.setExtraField(sv.Field(i), name); err != nil {
+			return fmt.Errorf("DecodeExtras: field %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// extraFieldName returns the name of the additional field struct field
+// f is decoded from.
+func extraFieldName(f reflect.StructField) string {
+	for _, key := range []string{"gelf", "json"} {
+		if tag, ok := f.Tag.Lookup(key); ok {
+			if name, _, _ := strings.Cut(tag, ","); name != "" {
+				return name
+			}
+		}
+	}
+	return f.Name
+}
+
+// setExtraField sets fv from the additional field name.
+func (m *Message) setExtraField(fv reflect.Value, name string) error {
+	val, _ := m.extra(name)
+
+	switch fv.Kind() {
+	case reflect.String:
+		if s, ok := m.ExtraString(name); ok {
+			fv.SetString(s)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := m.ExtraInt(name); ok {
+			if fv.OverflowInt(i) {
+				return fmt.Errorf("%d overflows %s", i, fv.Type())
+			}
+			fv.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if s, ok := m.ExtraString(name); ok {
+			if u, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64); err == nil {
+				if fv.OverflowUint(u) {
+					return fmt.Errorf("%d overflows %s", u, fv.Type())
+				}
+				fv.SetUint(u)
+				return nil
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := m.ExtraFloat(name); ok {
+			if fv.OverflowFloat(f) {
+				return fmt.Errorf("%g overflows %s", f, fv.Type())
+			}
+			fv.SetFloat(f)
+			return nil
+		}
+	case reflect.Bool:
+		switch b := val.(type) {
+		case bool:
+			fv.SetBool(b)
+			return nil
+		case string:
+			if parsed, err := strconv.ParseBool(strings.TrimSpace(b)); err == nil {
+				fv.SetBool(parsed)
+				return nil
+			}
+		}
+	case reflect.Interface:
+		if reflect.TypeOf(val).AssignableTo(fv.Type()) {
+			fv.Set(reflect.ValueOf(val))
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+
+	return fmt.Errorf("cannot use %v (%T) as %s", val, val, fv.Type())
+}
+
+func numberToInt(n json.Number) (int64, bool) {
+	if i, err := n.Int64(); err == nil {
+		return i, true
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return floatToInt(f)
+}
+
+// intValue converts the integer types a message built by hand may hold.
+func intValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return uintValue(uint64(v))
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return uintValue(v)
+	}
+	return 0, false
+}
+
+func uintValue(u uint64) (int64, bool) {
+	if u > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(u), true
+}
+
+// floatToInt converts f if it is a whole number an int64 can hold.
+func floatToInt(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
@@ -0,0 +1,204 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtraAccessors(t *testing.T) {
+	m := &Message{Extra: map[string]interface{}{
+		"str":     "text",
+		"numstr":  " 42 ",
+		"number":  json.Number("9007199254740993"),
+		"float":   2.5,
+		"whole":   3.0,
+		"huge":    1e30,
+		"int":     7,
+		"bool":    true,
+		"null":    nil,
+		"_prefix": "underscored",
+	}}
+
+	strs := map[string]string{
+		"str": "text", "number": "9007199254740993", "float": "2.5", "int": "7",
+		"bool": "true", "prefix": "underscored", "_str": "text",
+	}
+	for key, expected := range strs {
+		if s, ok := m.ExtraString(key); !ok || s != expected {
+			t.Errorf("ExtraString(%q): expected %q, got %q, %t", key, expected, s, ok)
+		}
+	}
+
+	floats := map[string]float64{"numstr": 42, "float": 2.5, "int": 7, "number": 9007199254740993}
+	for key, expected := range floats {
+		if f, ok := m.ExtraFloat(key); !ok || f != expected {
+			t.Errorf("ExtraFloat(%q): expected %g, got %g, %t", key, expected, f, ok)
+		}
+	}
+
+	ints := map[string]int64{"numstr": 42, "number": 9007199254740993, "whole": 3, "int": 7}
+	for key, expected := range ints {
+		if i, ok := m.ExtraInt(key); !ok || i != expected {
+			t.Errorf("ExtraInt(%q): expected %d, got %d, %t", key, expected, i, ok)
+		}
+	}
+
+	for _, key := range []string{"null", "missing"} {
+		if _, ok := m.ExtraString(key); ok {
+			t.Errorf("ExtraString(%q) succeeded", key)
+		}
+	}
+	for _, key := range []string{"str", "bool", "null"} {
+		if _, ok := m.ExtraFloat(key); ok {
+			t.Errorf("ExtraFloat(%q) succeeded", key)
+		}
+	}
+	for _, key := range []string{"str", "float", "huge", "bool"} {
+		if _, ok := m.ExtraInt(key); ok {
+			t.Errorf("ExtraInt(%q) succeeded", key)
+		}
+	}
+}
+
+func TestRangeExtras(t *testing.T) {
+	m := &Message{Extra: map[string]interface{}{"c": 3, "a": 1, "d": 4, "b": 2}}
+
+	if keys := strings.Join(m.SortedExtraKeys(), ","); keys != "a,b,c,d" {
+		t.Errorf("SortedExtraKeys: expected a,b,c,d, got %s", keys)
+	}
+
+	var visited []string
+	m.RangeExtras(func(key string, val interface{}) bool {
+		if val != m.Extra[key] {
+			t.Errorf("RangeExtras: %s: expected %v, got %v", key, m.Extra[key], val)
+		}
+		visited = append(visited, key)
+		return key != "c"
+	})
+	if keys := strings.Join(visited, ","); keys != "a,b,c" {
+		t.Errorf("RangeExtras: expected to stop after c, visited %s", keys)
+	}
+
+	if keys := new(Message).SortedExtraKeys(); len(keys) != 0 {
+		t.Errorf("SortedExtraKeys of no extras: got %v", keys)
+	}
+}
+
+func TestDecodeExtras(t *testing.T) {
+	type Common struct {
+		Service string `gelf:"service"`
+	}
+	var v struct {
+		Common
+		UserID   int64       `gelf:"user_id"`
+		Port     uint16      `json:"port,omitempty"`
+		Ratio    float64     `gelf:"ratio"`
+		Cached   bool        `gelf:"cached"`
+		Name     string      `gelf:"name"`
+		Code     string      `gelf:"code"`
+		Raw      interface{} `gelf:"raw"`
+		Missing  string      `gelf:"missing"`
+		Skipped  string      `gelf:"-"`
+		Untagged string
+		hidden   string
+	}
+	v.Missing = "unchanged"
+
+	m := &Message{Extra: map[string]interface{}{
+		"user_id":  json.Number("9007199254740993"),
+		"port":     json.Number("8080"),
+		"ratio":    "0.25",
+		"cached":   true,
+		"name":     "n",
+		"code":     json.Number("404"),
+		"raw":      json.Number("1.5"),
+		"service":  "api",
+		"Untagged": "u",
+		"Skipped":  "s",
+		"-":        "s",
+		"hidden":   "h",
+	}}
+	if err := m.DecodeExtras(&v); err != nil {
+		t.Fatalf("DecodeExtras: %s", err)
+	}
+	if v.UserID != 9007199254740993 || v.Port != 8080 || v.Ratio != 0.25 || !v.Cached {
+		t.Errorf("numbers not decoded: %+v", v)
+	}
+	if v.Name != "n" || v.Code != "404" || v.Raw != json.Number("1.5") || v.Service != "api" || v.Untagged != "u" {
+		t.Errorf("fields not decoded: %+v", v)
+	}
+	if v.Missing != "unchanged" || v.Skipped != "" || v.hidden != "" {
+		t.Errorf("fields that should be left alone changed: %+v", v)
+	}
+
+	// fields to be sent still have their underscore
+	var sent struct {
+		UserID int `gelf:"user_id"`
+	}
+	if err := (&Message{Extra: map[string]interface{}{"_user_id": 7}}).DecodeExtras(&sent); err != nil || sent.UserID != 7 {
+		t.Errorf("DecodeExtras of _user_id: got %d, %v", sent.UserID, err)
+	}
+
+	var small struct {
+		N int8 `gelf:"n"`
+	}
+	if err := (&Message{Extra: map[string]interface{}{"n": json.Number("300")}}).DecodeExtras(&small); err == nil {
+		t.Errorf("DecodeExtras accepted 300 for an int8")
+	}
+	var mistyped struct {
+		N int `gelf:"n"`
+	}
+	if err := (&Message{Extra: map[string]interface{}{"n": "many"}}).DecodeExtras(&mistyped); err == nil {
+		t.Errorf("DecodeExtras accepted \"many\" for an int")
+	}
+	if err := m.DecodeExtras(v); err == nil {
+		t.Errorf("DecodeExtras accepted a struct rather than a pointer")
+	}
+}
+
+func TestNormalizeExtraKeys(t *testing.T) {
+	fields := func() map[string]interface{} {
+		return map[string]interface{}{
+			"ok.key-1":  1,
+			"user name": "a",
+			"user_name": "b",
+			"user/name": "c",
+			"path/to":   "d",
+			"café":      "e",
+			"":          "f",
+		}
+	}
+
+	m := &Message{Extra: fields()}
+	m.NormalizeExtraKeys(ExtraKeyReplace)
+	expected := map[string]interface{}{
+		"ok.key-1":    1,
+		"user_name":   "b",
+		"user_name_2": "a",
+		"user_name_3": "c",
+		"path_to":     "d",
+		"caf_":        "e",
+	}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Errorf("ExtraKeyReplace: expected %v, got %v", expected, m.Extra)
+	}
+
+	m = &Message{Extra: fields()}
+	m.NormalizeExtraKeys(ExtraKeyDrop)
+	expected = map[string]interface{}{"ok.key-1": 1, "user_name": "b"}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Errorf("ExtraKeyDrop: expected %v, got %v", expected, m.Extra)
+	}
+
+	m = &Message{Extra: fields()}
+	m.NormalizeExtraKeys(ExtraKeyKeep)
+	if !reflect.DeepEqual(m.Extra, fields()) {
+		t.Errorf("ExtraKeyKeep changed the fields: %v", m.Extra)
+	}
+}
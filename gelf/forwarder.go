@@ -0,0 +1,111 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// Forwarder relays the messages a Reader receives to a Writer.  The
+// JSON of every message is sent on as it was received, with
+// Writer.WriteRaw, so that only the Writer's compression and chunk
+// size decide how it travels: a relay may forward to a link with a
+// different MTU, or compress what arrived uncompressed.
+type Forwarder struct {
+	in        *Reader
+	out       *Writer
+	errorFunc func(error)
+
+	forwarded, readErrors, writeErrors atomic.Uint64
+}
+
+// ForwarderStats counts what a Forwarder has done since it was
+// created.
+type ForwarderStats struct {
+	Forwarded   uint64 // messages written to the Writer
+	ReadErrors  uint64 // messages that could not be read, and were skipped
+	WriteErrors uint64 // messages the Writer failed to send
+}
+
+// NewForwarder returns a Forwarder from in to out.  Nothing is read
+// until Run is called.
+func NewForwarder(in *Reader, out *Writer) *Forwarder {
+	return &Forwarder{in: in, out: out}
+}
+
+// SetErrorFunc sets a function called with every error Run skips past,
+// from reading or writing a message.  Errors are only counted by
+// default.  It must be set before Run is called.
+func (f *Forwarder) SetErrorFunc(fn func(error)) {
+	f.errorFunc = fn
+}
+
+// Run forwards messages until ctx is done, returning ctx.Err(), or
+// until the Reader or Writer is closed, returning ErrReaderClosed or
+// ErrWriterClosed.  A message already read when ctx is done is still
+// sent.  Messages that can't be read or sent are skipped, and counted
+// in Stats.  The Reader must not be read from while Run is running.
+func (f *Forwarder) Run(ctx context.Context) error {
+	for {
+		var raw []byte
+		err := f.in.readContext(ctx, func() (err error) {
+			_, raw, err = f.in.ReadMessageRaw()
+			return err
+		})
+		if err == nil {
+			// sent even if ctx is done by now, rather than lost
+			if werr := f.forward(raw); werr != nil {
+				return werr
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == ErrReaderClosed {
+			return err
+		}
+		if err != nil {
+			f.readErrors.Add(1)
+			f.report(err)
+		}
+	}
+}
+
+// forward writes raw to the Writer, counting and reporting the
+// failure if it can't be sent.  It only returns ErrWriterClosed.
+func (f *Forwarder) forward(raw []byte) error {
+	err := f.out.WriteRaw(raw)
+	// a closed UDP Writer fails on its closed socket
+	if err == ErrWriterClosed || errors.Is(err, net.ErrClosed) {
+		return ErrWriterClosed
+	}
+	if err != nil {
+		f.writeErrors.Add(1)
+		f.report(err)
+		return nil
+	}
+	f.forwarded.Add(1)
+	return nil
+}
+
+func (f *Forwarder) report(err error) {
+	if f.errorFunc != nil {
+		f.errorFunc(err)
+	}
+}
+
+// Stats returns a snapshot of the forwarder's counters.  It may be
+// called concurrently with Run.
+func (f *Forwarder) Stats() ForwarderStats {
+	return ForwarderStats{
+		Forwarded:   f.forwarded.Load(),
+		ReadErrors:  f.readErrors.Load(),
+		WriteErrors: f.writeErrors.Load(),
+	}
+}
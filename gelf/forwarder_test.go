@@ -0,0 +1,178 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwarder(t *testing.T) {
+	in, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer in.Close()
+	dst, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer dst.Close()
+
+	out, err := NewWriter(dst.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer out.Close()
+	out.CompressionType = CompressNone
+	out.SetChunkSize(300)
+
+	errs := make(chan error, 1)
+	f := NewForwarder(in, out)
+	f.SetErrorFunc(func(err error) { errs <- err })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.Run(ctx) }()
+
+	conn, err := net.Dial("udp", in.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("not json"))
+	select {
+	case err = <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no error reported for an invalid message")
+	}
+
+	w, err := NewWriter(in.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	full := strings.Repeat("forwarded ", 100)
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "fwd", Full: full}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	msg, err := dst.ReadMessageContext(ctxTimeout(t, 5*time.Second))
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "fwd" || msg.Full != full {
+		t.Errorf("unexpected message %s", msg)
+	}
+	if s := dst.Stats(); s.Reassembled != 1 {
+		t.Errorf("expected the message rechunked, got stats %+v", s)
+	}
+
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Errorf("Run: expected context.Canceled, got %v", err)
+	}
+	if s := f.Stats(); s.Forwarded != 1 || s.ReadErrors != 1 || s.WriteErrors != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestForwarderReaderClosed(t *testing.T) {
+	in, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	out := &Writer{conn: new(recordingConn)}
+
+	f := NewForwarder(in, out)
+	done := make(chan error)
+	go func() { done <- f.Run(context.Background()) }()
+
+	time.Sleep(20 * time.Millisecond)
+	in.Close()
+	select {
+	case err = <-done:
+		if err != ErrReaderClosed {
+			t.Errorf("Run: expected ErrReaderClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't return after the reader was closed")
+	}
+}
+
+func TestForwarderWriterClosed(t *testing.T) {
+	w, in, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer in.Close()
+	out, err := NewWriter("127.0.0.1:12201")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	out.Close()
+
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "m"})
+	f := NewForwarder(in, out)
+	if err = f.Run(ctxTimeout(t, 5*time.Second)); err != ErrWriterClosed {
+		t.Errorf("Run: expected ErrWriterClosed, got %v", err)
+	}
+	if stats := f.Stats(); stats.WriteErrors != 0 {
+		t.Errorf("WriteErrors: expected 0, got %d", stats.WriteErrors)
+	}
+}
+
+// cancelConn hands out datagram, cancelling a context as it does, as
+// if the context were cancelled just as the message arrived.
+type cancelConn struct {
+	replayConn
+	cancel context.CancelFunc
+}
+
+func (c *cancelConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.cancel()
+	return c.replayConn.ReadFrom(b)
+}
+
+func (c *cancelConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// tests that a message read as the context is cancelled is still
+// forwarded
+func TestForwarderCancelledAfterRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in, err := newReader(&cancelConn{
+		replayConn: replayConn{datagram: []byte(`{"version":"1.1","host":"h","short_message":"last"}`)},
+		cancel:     cancel,
+	}, nil)
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+	conn := new(recordingConn)
+	out := &Writer{conn: conn, CompressionType: CompressNone}
+
+	f := NewForwarder(in, out)
+	if err = f.Run(ctx); err != context.Canceled {
+		t.Errorf("Run: expected context.Canceled, got %v", err)
+	}
+	if !strings.Contains(string(conn.last), `"short_message":"last"`) {
+		t.Errorf("message not forwarded, sent %q", conn.last)
+	}
+	if s := f.Stats(); s.Forwarded != 1 {
+		t.Errorf("Forwarded: expected 1, got %d", s.Forwarded)
+	}
+}
+
+// ctxTimeout returns a context cancelled after d, or when t ends.
+func ctxTimeout(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,101 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"testing"
+)
+
+// fuzzSeeds returns well-formed datagrams of every kind the decoder
+// handles, for the fuzzers to start from.
+func fuzzSeeds() [][]byte {
+	plain := []byte(`{"version":"1.1","host":"h","short_message":"s","timestamp":1.5,"level":3,"_n":1,"x":null}`)
+
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(plain)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(plain)
+	zw.Close()
+
+	return [][]byte{
+		plain,
+		gz.Bytes(),
+		zl.Bytes(),
+		zstdRaw(plain),
+		append(chunk('a', 0, 2, string(plain[:20])), chunk('a', 1, 2, string(plain[20:]))...),
+		chunk('a', 0, 1, string(gz.Bytes())),
+		[]byte(`{"version":1,"host":[],"short_message":{},"level":"x","line":true}`),
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DecodeMessage(bytes.NewReader(data))
+		if err == nil && msg == nil {
+			t.Errorf("DecodeMessage returned neither a message nor an error")
+		}
+	})
+}
+
+// datagramConn hands out the datagrams it holds, one per read, then
+// fails with io.EOF.
+type datagramConn struct {
+	replayConn
+	datagrams [][]byte
+}
+
+func (c *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.datagrams) == 0 {
+		return 0, nil, io.EOF
+	}
+	n := copy(b, c.datagrams[0])
+	c.datagrams = c.datagrams[1:]
+	return n, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12201}, nil
+}
+
+// datagramSep separates the datagrams FuzzReadToMap reads from its
+// input.
+var datagramSep = []byte("\n--\n")
+
+func FuzzReadToMap(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Add(bytes.Join([][]byte{
+		chunk('b', 1, 3, "_message\":\"s\"}"),
+		chunk('b', 0, 3, `{"version":"1.1",`),
+		chunk('c', 0, 1, `{}`),
+		chunk('b', 2, 3, ""),
+		[]byte(`{"version":"1.1","host":"h","short_message":"s"}`),
+	}, datagramSep))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		datagrams := bytes.Split(data, datagramSep)
+
+		r, err := newReader(&datagramConn{datagrams: datagrams}, []ReaderOption{
+			WithDecompressor(NewZstdDecompressor(unzstdRaw)),
+			WithRawDeflate(),
+		})
+		if err != nil {
+			t.Fatalf("newReader: %s", err)
+		}
+		for i := 0; i <= len(datagrams); i++ {
+			if _, err = r.ReadMessage(); err == io.EOF {
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+)
+
+// GELFHTTPHandler returns a handler receiving GELF messages as Graylog's
+// HTTP input does: every POST request carries a single JSON message,
+// which may be compressed as a Reader would accept, and must be when
+// the request has a "Content-Encoding: gzip" header.  onMessage is
+// called with each message, from the goroutine serving its request.
+// The handler responds 202 Accepted to a valid message, and 400 Bad
+// Request to a body that can't be decoded.
+func GELFHTTPHandler(onMessage func(*Message)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body := bufio.NewReader(http.MaxBytesReader(rw, req.Body, defaultMaxDecompressedSize))
+
+		switch req.Header.Get("Content-Encoding") {
+		case "", "identity":
+		case "gzip":
+			// decoding detects gzip by itself, as long as it's there
+			if head, _ := body.Peek(len(magicGzip)); !bytes.Equal(head, magicGzip) {
+				http.Error(rw, "body is not gzipped", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(rw, "unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		msg, err := DecodeMessage(body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		onMessage(msg)
+		rw.WriteHeader(http.StatusAccepted)
+	})
+}
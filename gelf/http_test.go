@@ -0,0 +1,72 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGELFHTTPHandler(t *testing.T) {
+	var got []*Message
+	srv := httptest.NewServer(GELFHTTPHandler(func(m *Message) {
+		got = append(got, m)
+	}))
+	defer srv.Close()
+
+	post := func(body []byte, encoding string) int {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	plain := []byte(`{"version":"1.1","host":"h","short_message":"plain"}`)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(`{"version":"1.1","host":"h","short_message":"gzipped"}`))
+	zw.Close()
+
+	for _, tc := range []struct {
+		body     []byte
+		encoding string
+		status   int
+	}{
+		{plain, "", http.StatusAccepted},
+		{gzipped.Bytes(), "gzip", http.StatusAccepted},
+		{plain, "gzip", http.StatusBadRequest},
+		{plain, "br", http.StatusUnsupportedMediaType},
+		{[]byte(`{"version":`), "", http.StatusBadRequest},
+	} {
+		if status := post(tc.body, tc.encoding); status != tc.status {
+			t.Errorf("POST %q (%s): expected status %d, got %d", tc.body, tc.encoding, tc.status, status)
+		}
+	}
+
+	if len(got) != 2 || got[0].Short != "plain" || got[1].Short != "gzipped" {
+		t.Errorf("expected the plain and gzipped messages, got %d messages", len(got))
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected status 405, got %d", resp.StatusCode)
+	}
+}
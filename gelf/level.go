@@ -0,0 +1,43 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"strconv"
+)
+
+// GELF levels.  These are the syslog severities, so a lower number
+// means a more severe message.
+const (
+	LevelEmergency int32 = iota
+	LevelAlert
+	LevelCritical
+	LevelError
+	LevelWarning
+	LevelNotice
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = [...]string{
+	LevelEmergency: "EMERGENCY",
+	LevelAlert:     "ALERT",
+	LevelCritical:  "CRITICAL",
+	LevelError:     "ERROR",
+	LevelWarning:   "WARNING",
+	LevelNotice:    "NOTICE",
+	LevelInfo:      "INFO",
+	LevelDebug:     "DEBUG",
+}
+
+// LevelName returns the name of a GELF level, like "ERROR" for
+// LevelError.  Levels outside of the syslog range are named after
+// their number, like "level(9)".
+func LevelName(level int32) string {
+	if level < 0 || int(level) >= len(levelNames) {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return levelNames[level]
+}
@@ -0,0 +1,24 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"testing"
+)
+
+func TestLevelName(t *testing.T) {
+	for level, expected := range map[int32]string{
+		LevelEmergency: "EMERGENCY",
+		LevelError:     "ERROR",
+		LOG_INFO:       "INFO",
+		LevelDebug:     "DEBUG",
+		8:              "level(8)",
+		-1:             "level(-1)",
+	} {
+		if name := LevelName(level); name != expected {
+			t.Errorf("LevelName(%d): expected %s, got %s", level, expected, name)
+		}
+	}
+}
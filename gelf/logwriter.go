@@ -0,0 +1,43 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+)
+
+// LogWriter is an io.Writer turning every Write into a GELF message,
+// so that log.Logger and other libraries writing to an io.Writer can
+// log to a GELF server.  Write doesn't split its input into lines: a
+// multi-line write becomes a single message, whose short message is
+// the first line and whose full message is the whole input.  This
+// keeps stack traces and other multi-line log entries together.
+type LogWriter struct {
+	w        MessageWriter
+	Host     string
+	Facility string
+	Level    int32 // LevelInfo by default
+}
+
+// NewLogWriter returns a LogWriter sending messages from host through
+// w.
+func NewLogWriter(w MessageWriter, host string) *LogWriter {
+	return &LogWriter{w: w, Host: host, Level: LevelInfo}
+}
+
+// Write sends p, trimmed of surrounding whitespace, as a message
+// with the file and line it was logged from as additional fields.
+func (lw *LogWriter) Write(p []byte) (n int, err error) {
+	// 1 for the function that called us.
+	file, line := getCallerIgnoringLogMulti(1)
+
+	m := lineMessage(bytes.TrimSpace(p), lw.Host, lw.Facility, file, line)
+	m.Level = lw.Level
+	if err = lw.w.WriteMessage(m); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"log"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	var rec messageRecorder
+	lw := NewLogWriter(&rec, "web-1")
+	lw.Facility = "api"
+	logger := log.New(lw, "", 0)
+
+	logger.Print("one line")
+	logger.Print("panic: boom\n\tmain.go:12")
+
+	if len(rec) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(rec))
+	}
+
+	if rec[0].Short != "one line" || rec[0].Full != "" {
+		t.Errorf("expected short message one line only, got %q and %q", rec[0].Short, rec[0].Full)
+	}
+	if rec[1].Short != "panic: boom" || rec[1].Full != "panic: boom\n\tmain.go:12" {
+		t.Errorf("expected the first line as short message, got %q and %q", rec[1].Short, rec[1].Full)
+	}
+
+	for _, m := range rec {
+		if m.Host != "web-1" || m.Facility != "api" || m.Level != LevelInfo {
+			t.Errorf("expected host web-1, facility api and level info, got %s, %s and %d",
+				m.Host, m.Facility, m.Level)
+		}
+		if _, ok := m.Extra["_file"]; !ok {
+			t.Errorf("expected a _file field, got %v", m.Extra)
+		}
+	}
+}
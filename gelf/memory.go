@@ -0,0 +1,146 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewMemoryReaderWriter returns a Writer and a Reader connected in
+// memory, for tests: every datagram the Writer sends is queued, in
+// order, for the Reader, with nothing lost and no socket involved.
+// The Writer compresses and chunks messages, and the Reader
+// reassembles and decodes them, as they would over UDP, and both may
+// be configured as usual.  The queue has no bound, so a test may
+// write messages before reading them back.  Closing either end closes
+// both, though the Reader still gets the messages written before the
+// Writer was closed.
+func NewMemoryReaderWriter() (*Writer, *Reader, error) {
+	conn := newMemConn()
+
+	w, err := newWriter()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = conn
+
+	r, err := newReader(conn, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, r, nil
+}
+
+// memConn is both ends of an in-memory datagram connection: what is
+// written to it is read back from it.
+type memConn struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    [][]byte
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer // wakes up reads at the deadline
+}
+
+func newMemConn() *memConn {
+	c := new(memConn)
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// memAddr is the address of both ends of a memConn.
+type memAddr struct{}
+
+func (memAddr) Network() string { return "memory" }
+func (memAddr) String() string  { return "memory" }
+
+func (c *memConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// ReadFrom returns the next datagram, truncated to fit b, like UDP.
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.queue) == 0 {
+		switch {
+		case c.closed:
+			return 0, nil, net.ErrClosed
+		case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	n := copy(b, c.queue[0])
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	return n, memAddr{}, nil
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, memAddr{})
+}
+
+func (c *memConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.queue = append(c.queue, append([]byte(nil), b...))
+	c.cond.Broadcast()
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return memAddr{} }
+func (c *memConn) RemoteAddr() net.Addr { return memAddr{} }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
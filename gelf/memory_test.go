@@ -0,0 +1,61 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMemoryReaderWriter(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+
+	// random bytes don't compress, so the message is chunked
+	raw := make([]byte, 3*ChunkSize)
+	rand.New(rand.NewSource(1)).Read(raw)
+	long := hex.EncodeToString(raw)
+
+	w.CompressionType = CompressGzip
+	msgs := []string{"first", long, "last"}
+	for _, short := range msgs {
+		if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+
+	for _, short := range msgs {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != short {
+			t.Errorf("msg.Short: expected %.20q, got %.20q", short, msg.Short)
+		}
+	}
+	if stats := r.Stats(); stats.Reassembled != 1 {
+		t.Errorf("Reassembled: expected 1, got %d", stats.Reassembled)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = r.ReadMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReadMessageContext on empty queue: expected DeadlineExceeded, got %v", err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err = r.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage after Close: expected an error")
+	}
+}
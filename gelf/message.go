@@ -0,0 +1,512 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrReservedField is returned when marshaling a message whose extra
+// fields include "_id", which the GELF spec reserves.
+var ErrReservedField = errors.New("extra field _id is reserved")
+
+// Message represents the contents of the GELF message.  It is gzipped
+// before sending.  Facility, File and Line are standard fields of GELF
+// 1.0, which GELF 1.1 deprecated; see Reader.SetSpecVersion.
+type Message struct {
+	Version  string                 `json:"version"`
+	Host     string                 `json:"host"`
+	Short    string                 `json:"short_message"`
+	Full     string                 `json:"full_message,omitempty"`
+	TimeUnix float64                `json:"timestamp"`
+	Level    int32                  `json:"level"`
+	Facility string                 `json:"facility,omitempty"`
+	Extra    map[string]interface{} `json:"-"`
+	File     string                 `json:"file,omitempty"`
+	Line     int32                  `json:"line,omitempty"`
+	RawExtra json.RawMessage        `json:"-"`
+	// Unknown holds the top-level fields of a decoded message that
+	// are neither standard GELF fields nor additional fields.
+	// MarshalJSON sends them back as they are.
+	Unknown map[string]interface{} `json:"-"`
+	// Transport tells how a message read by a Reader was received.
+	Transport Transport `json:"-"`
+}
+
+// Transport describes how a message was received.
+type Transport struct {
+	Chunked    bool
+	ChunkCount int // 1 if not chunked
+	// Compression is "gzip", "zlib", "deflate" (see WithRawDeflate),
+	// "none", or the name of the Decompressor the message was
+	// decompressed with.
+	Compression string
+}
+
+// The top-level fields Message has a field of its own for.
+var standardFields = map[string]bool{
+	"version":       true,
+	"host":          true,
+	"short_message": true,
+	"full_message":  true,
+	"timestamp":     true,
+	"level":         true,
+	"facility":      true,
+	"file":          true,
+	"line":          true,
+}
+
+// NewErrorMessage returns a message reporting err, sent from host at
+// the current time with level LevelError.  The short message is
+// err.Error(), and the type of err is added in the "error_type" extra
+// field.  Errors that format with more detail under "%+v", like those
+// of github.com/pkg/errors, which print their stack trace that way,
+// get that detail as the full message.
+func NewErrorMessage(host string, err error) *Message {
+	m := &Message{
+		Version: "1.1",
+		Host:    host,
+		Short:   err.Error(),
+		Level:   LevelError,
+		Extra:   map[string]interface{}{"error_type": fmt.Sprintf("%T", err)},
+	}
+	m.SetTime(time.Now())
+
+	if _, ok := err.(fmt.Formatter); ok {
+		if full := fmt.Sprintf("%+v", err); full != m.Short {
+			m.Full = full
+		}
+	}
+
+	return m
+}
+
+// messageFields has the fields of Message, but none of its methods,
+// so that marshaling it doesn't recurse into Message.MarshalJSON.
+type messageFields Message
+
+// MarshalJSON encodes m as a GELF JSON document.  Extra fields become
+// additional top-level fields, with an underscore prepended to their
+// names if it is missing.  An "id" extra field is rejected with
+// ErrReservedField.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.MarshalJSONBuf(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalJSONBuf is like MarshalJSON, but writes the encoded message
+// to buf.
+func (m *Message) MarshalJSONBuf(buf *bytes.Buffer) error {
+	return m.marshalJSONBuf(buf, stdCodec{})
+}
+
+func (m *Message) marshalJSONBuf(buf *bytes.Buffer, codec JSONCodec) error {
+	extra, err := m.prefixedExtra()
+	if err != nil {
+		return err
+	}
+
+	b, err := codec.Marshal((*messageFields)(m))
+	if err != nil {
+		return err
+	}
+	// write up until the final }
+	if _, err = buf.Write(b[:len(b)-1]); err != nil {
+		return err
+	}
+	if len(extra) > 0 {
+		eb, err := codec.Marshal(extra)
+		if err != nil {
+			return err
+		}
+		// merge serialized message + serialized extra map
+		if err = buf.WriteByte(','); err != nil {
+			return err
+		}
+		// write serialized extra bytes, without enclosing quotes
+		if _, err = buf.Write(eb[1 : len(eb)-1]); err != nil {
+			return err
+		}
+	}
+
+	if unknown := m.unknownFields(); len(unknown) > 0 {
+		ub, err := codec.Marshal(unknown)
+		if err != nil {
+			return err
+		}
+		if err = buf.WriteByte(','); err != nil {
+			return err
+		}
+		if _, err = buf.Write(ub[1 : len(ub)-1]); err != nil {
+			return err
+		}
+	}
+
+	if len(m.RawExtra) > 0 {
+		if err := buf.WriteByte(','); err != nil {
+			return err
+		}
+
+		// write serialized extra bytes, without enclosing quotes
+		if _, err = buf.Write(m.RawExtra[1 : len(m.RawExtra)-1]); err != nil {
+			return err
+		}
+	}
+
+	// write final closing quotes
+	return buf.WriteByte('}')
+}
+
+// prefixedExtra returns m.Extra with every key starting with an
+// underscore, as GELF additional fields must.  If both "foo" and
+// "_foo" are present, the value of "_foo" wins.
+func (m *Message) prefixedExtra() (map[string]interface{}, error) {
+	if len(m.Extra) == 0 {
+		return nil, nil
+	}
+
+	extra := make(map[string]interface{}, len(m.Extra))
+	for k, v := range m.Extra {
+		key := k
+		if !strings.HasPrefix(k, "_") {
+			key = "_" + k
+			if _, ok := m.Extra[key]; ok {
+				continue
+			}
+		}
+		if key == "_id" {
+			return nil, ErrReservedField
+		}
+		extra[key] = v
+	}
+
+	return extra, nil
+}
+
+// unknownFields returns the fields of m.Unknown that clash neither
+// with standard fields nor with additional fields.
+func (m *Message) unknownFields() map[string]interface{} {
+	if len(m.Unknown) == 0 {
+		return nil
+	}
+
+	unknown := make(map[string]interface{}, len(m.Unknown))
+	for k, v := range m.Unknown {
+		if !standardFields[k] && !strings.HasPrefix(k, "_") {
+			unknown[k] = v
+		}
+	}
+	return unknown
+}
+
+// UnmarshalJSON decodes a GELF JSON document into m, the same way
+// Reader.ReadMessage does: numbers in extra fields are kept as
+// json.Number, and the leading underscore of additional field names
+// is dropped when they are moved into m.Extra.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var mapped map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&mapped); err != nil {
+		return err
+	}
+
+	m.fromMap(mapped)
+
+	return nil
+}
+
+// fromMap sets the fields of m from a decoded GELF JSON object.
+// Additional fields are added to m.Extra without their leading
+// underscore.  Standard fields of the wrong type are ignored.
+func (m *Message) fromMap(mapped map[string]interface{}) {
+	if v, ok := mapped["version"].(string); ok {
+		m.Version = v
+	}
+
+	if v, ok := mapped["host"].(string); ok {
+		m.Host = v
+	}
+
+	if v, ok := mapped["short_message"].(string); ok {
+		m.Short = v
+	}
+
+	if v, ok := mapped["full_message"].(string); ok && len(v) > 0 {
+		m.Full = v
+	}
+
+	if val, ok := mapped["timestamp"]; ok && val != nil {
+		switch val.(type) {
+		case string:
+			v, err := strconv.ParseFloat(val.(string), 64)
+			if err == nil {
+				m.TimeUnix = v
+			}
+		case float64:
+			m.TimeUnix = val.(float64)
+		case json.Number:
+			v, err := val.(json.Number).Float64()
+			if err == nil {
+				m.TimeUnix = v
+			}
+		case int:
+			m.TimeUnix = float64(val.(int))
+		case int64:
+			m.TimeUnix = float64(val.(int64))
+		}
+	}
+
+	if v, ok := int32Field(mapped["level"]); ok {
+		m.Level = v
+	}
+
+	if v, ok := mapped["facility"].(string); ok && len(v) > 0 {
+		m.Facility = v
+	}
+
+	if v, ok := mapped["file"].(string); ok && len(v) > 0 {
+		m.File = v
+	}
+
+	if v, ok := int32Field(mapped["line"]); ok {
+		m.Line = v
+	}
+
+	// Move fields started with underscore into "Extra", and the
+	// others we don't know into "Unknown"
+	for k, v := range mapped {
+		if strings.HasPrefix(k, "_") {
+			if v == nil {
+				continue
+			}
+			if m.Extra == nil {
+				m.Extra = make(map[string]interface{})
+			}
+			m.Extra[k[1:len(k)]] = v
+		} else if !standardFields[k] {
+			if m.Unknown == nil {
+				m.Unknown = make(map[string]interface{})
+			}
+			m.Unknown[k] = v
+		}
+	}
+}
+
+// Reset zeroes m so that it can be decoded into again, keeping its
+// Extra and Unknown maps, emptied, to save allocating new ones.
+func (m *Message) Reset() {
+	extra, unknown := m.Extra, m.Unknown
+	clear(extra)
+	clear(unknown)
+	*m = Message{Extra: extra, Unknown: unknown}
+}
+
+// int32Field converts the decoded value of an integer field, reporting
+// whether it was a number.
+func int32Field(val interface{}) (int32, bool) {
+	switch val := val.(type) {
+	case float64:
+		return int32(val), true
+	case int32:
+		return val, true
+	case json.Number:
+		v, err := val.Float64()
+		if err == nil {
+			return int32(v), true
+		}
+	}
+	return 0, false
+}
+
+// Time returns the message's timestamp as a time.Time, or the zero
+// time if it has none.
+func (m *Message) Time() time.Time {
+	if m.TimeUnix == 0 {
+		return time.Time{}
+	}
+
+	sec := math.Floor(m.TimeUnix)
+	nsec := math.Round((m.TimeUnix - sec) * 1e9)
+	if nsec >= 1e9 {
+		sec, nsec = sec+1, 0
+	}
+
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// String formats m as a log line, for debugging: its time in UTC, or
+// "-" without one, host, level name and short message, then the extra
+// fields sorted by name, like
+//
+//	2024-01-02T03:04:05Z web1 ERROR disk full {device=sda1 free=0}
+func (m *Message) String() string {
+	var b strings.Builder
+
+	if t := m.Time(); t.IsZero() {
+		b.WriteString("-")
+	} else {
+		b.WriteString(t.UTC().Format(time.RFC3339Nano))
+	}
+	b.WriteString(" ")
+	b.WriteString(m.Host)
+	b.WriteString(" ")
+	b.WriteString(LevelName(m.Level))
+	b.WriteString(" ")
+	b.WriteString(m.Short)
+
+	if len(m.Extra) > 0 {
+		b.WriteString(" {")
+		sep := ""
+		m.RangeExtras(func(k string, v interface{}) bool {
+			fmt.Fprintf(&b, "%s%s=%v", sep, k, v)
+			sep = " "
+			return true
+		})
+		b.WriteString("}")
+	}
+
+	return b.String()
+}
+
+// SetTime sets the message's timestamp from t.  A float64 holds
+// current dates to about a microsecond, so finer detail is lost.
+func (m *Message) SetTime(t time.Time) {
+	if t.IsZero() {
+		m.TimeUnix = 0
+		return
+	}
+
+	m.TimeUnix = float64(t.Unix()) + float64(t.Nanosecond())/1e9
+}
+
+// prefixExtra returns extra with its keys prefixed with an underscore,
+// as they are sent.
+func prefixExtra(extra map[string]interface{}) map[string]interface{} {
+	prefixed := make(map[string]interface{}, len(extra))
+	for k, v := range extra {
+		prefixed["_"+k] = v
+	}
+	return prefixed
+}
+
+// flattenExtra returns extra with the objects and arrays it holds
+// replaced by their leaves, as documented in Reader.SetFlattenExtras.
+func flattenExtra(extra map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{}, len(extra))
+
+	var nested []string
+	for k, v := range extra {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			nested = append(nested, k)
+		default:
+			flat[k] = v
+		}
+	}
+
+	// sorted, so that colliding names always resolve the same way
+	sort.Strings(nested)
+	for _, k := range nested {
+		flattenValue(flat, k, extra[k])
+	}
+
+	if len(flat) == 0 {
+		return nil
+	}
+	return flat
+}
+
+func flattenValue(flat map[string]interface{}, key string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			flattenValue(flat, key+"."+k, v[k])
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenValue(flat, key+"."+strconv.Itoa(i), e)
+		}
+	default:
+		if _, ok := flat[key]; !ok {
+			flat[key] = v
+		}
+	}
+}
+
+// The extra field names reserved by GELF, with and without the
+// underscore it prefixes the field "_id" with.
+var reservedExtras = [...]string{"id", "_id"}
+
+// renamedID is the extra field SanitizeExtras moves "id" to.
+const renamedID = "orig_id"
+
+// SanitizeExtras renames the reserved extra field "id" (sent as
+// "_id") to "orig_id", so that m can be sent to Graylog without
+// losing its value.  An "_id" key, which MarshalJSON would send as is,
+// is renamed the same way.  If m already has an "orig_id" field, the
+// reserved fields are dropped instead.
+func (m *Message) SanitizeExtras() {
+	for _, k := range reservedExtras {
+		v, ok := m.Extra[k]
+		if !ok {
+			continue
+		}
+		delete(m.Extra, k)
+		if _, taken := m.Extra[renamedID]; !taken {
+			m.Extra[renamedID] = v
+		}
+	}
+}
+
+// dropReserved removes the reserved extra fields from m.
+func (m *Message) dropReserved() {
+	for _, k := range reservedExtras {
+		delete(m.Extra, k)
+	}
+}
+
+// Validate checks that m is a valid GELF message: its version must be
+// "1.1" or "1.0", its host and short message must not be empty, and
+// it must not have the reserved "id" extra field.  Every problem found
+// is reported, joined into a single error.
+func (m *Message) Validate() error {
+	var errs []error
+
+	if m.Version != "1.1" && m.Version != "1.0" {
+		errs = append(errs, fmt.Errorf("unsupported version %q", m.Version))
+	}
+	if m.Host == "" {
+		errs = append(errs, errors.New("missing host"))
+	}
+	if m.Short == "" {
+		errs = append(errs, errors.New("missing short_message"))
+	}
+	for _, k := range reservedExtras {
+		if _, ok := m.Extra[k]; ok {
+			errs = append(errs, ErrReservedField)
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
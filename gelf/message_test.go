@@ -0,0 +1,307 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageMarshalJSON(t *testing.T) {
+	m := &Message{
+		Version:  "1.1",
+		Host:     "h",
+		Short:    "short",
+		TimeUnix: 1385053862.3072,
+		Level:    LOG_EMERG,
+		Extra: map[string]interface{}{
+			"user_id": 42,
+			"_file":   "main.go",
+		},
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+
+	var mapped map[string]interface{}
+	if err = json.Unmarshal(b, &mapped); err != nil {
+		t.Fatalf("Unmarshal(%s): %s", b, err)
+	}
+
+	expected := map[string]interface{}{
+		"version":       "1.1",
+		"host":          "h",
+		"short_message": "short",
+		"timestamp":     1385053862.3072,
+		"level":         float64(0),
+		"_user_id":      float64(42),
+		"_file":         "main.go",
+	}
+	if len(mapped) != len(expected) {
+		t.Errorf("expected fields %v, got %s", expected, b)
+	}
+	for k, v := range expected {
+		if mapped[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, mapped[k])
+		}
+	}
+}
+
+func TestMessageMarshalJSONReservedID(t *testing.T) {
+	for _, key := range []string{"id", "_id"} {
+		m := &Message{
+			Version: "1.1",
+			Host:    "h",
+			Short:   "short",
+			Extra:   map[string]interface{}{key: 1},
+		}
+		if _, err := m.MarshalJSON(); err != ErrReservedField {
+			t.Errorf("extra %q: expected ErrReservedField, got %v", key, err)
+		}
+	}
+}
+
+func TestMessageSanitizeExtras(t *testing.T) {
+	m := &Message{Extra: map[string]interface{}{"id": 1, "a": 2}}
+	m.SanitizeExtras()
+	if len(m.Extra) != 2 || m.Extra["orig_id"] != 1 || m.Extra["a"] != 2 {
+		t.Errorf("expected id renamed to orig_id, got %v", m.Extra)
+	}
+	if _, err := m.MarshalJSON(); err != nil {
+		t.Errorf("MarshalJSON: %s", err)
+	}
+
+	m = &Message{Extra: map[string]interface{}{"_id": 1, "orig_id": 2}}
+	m.SanitizeExtras()
+	if len(m.Extra) != 1 || m.Extra["orig_id"] != 2 {
+		t.Errorf("expected _id dropped, got %v", m.Extra)
+	}
+}
+
+func TestMessageUnmarshalJSON(t *testing.T) {
+	in := &Message{
+		Version:  "1.1",
+		Host:     "h",
+		Short:    "short",
+		Full:     "full",
+		TimeUnix: 1385053862.3072,
+		Level:    LOG_ERR,
+		Extra:    map[string]interface{}{"user_id": 42},
+	}
+	b, err := in.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+
+	out := new(Message)
+	if err = json.Unmarshal(b, out); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+
+	if out.Version != in.Version || out.Host != in.Host || out.Short != in.Short ||
+		out.Full != in.Full || out.TimeUnix != in.TimeUnix || out.Level != in.Level {
+		t.Errorf("expected %+v, got %+v", in, out)
+	}
+	if len(out.Extra) != 1 || out.Extra["user_id"] != json.Number("42") {
+		t.Errorf("out.Extra: expected map[user_id:42], got %v", out.Extra)
+	}
+
+	// timestamps sent as strings
+	out = new(Message)
+	if err = out.UnmarshalJSON([]byte(`{"timestamp":"1385053862.5"}`)); err != nil {
+		t.Fatalf("UnmarshalJSON: %s", err)
+	}
+	if out.TimeUnix != 1385053862.5 {
+		t.Errorf("out.TimeUnix: expected 1385053862.5, got %v", out.TimeUnix)
+	}
+}
+
+func TestMessageUnknownFields(t *testing.T) {
+	in := `{"version":"1.1","host":"h","short_message":"s","_a":1,"_null":null,` +
+		`"vendor":"acme","meta":{"k":"v"}}`
+
+	m := new(Message)
+	if err := m.UnmarshalJSON([]byte(in)); err != nil {
+		t.Fatalf("UnmarshalJSON: %s", err)
+	}
+	if len(m.Unknown) != 2 || m.Unknown["vendor"] != "acme" {
+		t.Errorf("m.Unknown: expected vendor and meta, got %v", m.Unknown)
+	}
+	if len(m.Extra) != 1 {
+		t.Errorf("m.Extra: expected only a, got %v", m.Extra)
+	}
+
+	b, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+	var mapped map[string]interface{}
+	if err = json.Unmarshal(b, &mapped); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if mapped["vendor"] != "acme" || mapped["meta"] == nil {
+		t.Errorf("expected the unknown fields to be sent back, got %s", b)
+	}
+
+	// unknown fields don't override others
+	m.Unknown["host"] = "other"
+	m.Unknown["_a"] = 2
+	if b, err = m.MarshalJSON(); err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+	if err = json.Unmarshal(b, &mapped); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if mapped["host"] != "h" || mapped["_a"] != float64(1) {
+		t.Errorf("expected host h and _a 1, got %s", b)
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	m := new(Message)
+	if !m.Time().IsZero() {
+		t.Errorf("Time: expected the zero time, got %s", m.Time())
+	}
+
+	m.TimeUnix = 1385053862.25
+	if tm := m.Time(); !tm.Equal(time.Unix(1385053862, 250000000)) {
+		t.Errorf("Time: expected 1385053862.25, got %s", tm.Format(time.RFC3339Nano))
+	}
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	m.SetTime(now)
+	if d := m.Time().Sub(now); d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("Time: expected %s, got %s", now.Format(time.RFC3339Nano),
+			m.Time().UTC().Format(time.RFC3339Nano))
+	}
+
+	m.SetTime(time.Time{})
+	if m.TimeUnix != 0 {
+		t.Errorf("TimeUnix: expected 0 for the zero time, got %v", m.TimeUnix)
+	}
+}
+
+func TestMessageValidate(t *testing.T) {
+	valid := &Message{Version: "1.1", Host: "h", Short: "short"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate: unexpected error %s", err)
+	}
+
+	invalid := &Message{Version: "2", Extra: map[string]interface{}{"id": 1}}
+	err := invalid.Validate()
+	if err == nil {
+		t.Fatalf("Validate: expected an error")
+	}
+	for _, problem := range []string{"version", "host", "short_message", "_id"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Validate: %q doesn't mention %s", err, problem)
+		}
+	}
+	if !errors.Is(err, ErrReservedField) {
+		t.Errorf("Validate: expected %q to wrap ErrReservedField", err)
+	}
+}
+
+// stackError formats like the errors of github.com/pkg/errors.
+type stackError struct{ msg string }
+
+func (e stackError) Error() string { return e.msg }
+
+func (e stackError) Format(s fmt.State, verb rune) {
+	io.WriteString(s, e.msg)
+	if s.Flag('+') {
+		io.WriteString(s, "\nmain.main\n\t/src/main.go:42")
+	}
+}
+
+func TestNewErrorMessage(t *testing.T) {
+	m := NewErrorMessage("h", errors.New("plain"))
+	if m.Short != "plain" || m.Full != "" || m.Level != LevelError || m.Host != "h" {
+		t.Errorf("expected short message plain at level error, got %+v", m)
+	}
+	if m.Extra["error_type"] != "*errors.errorString" {
+		t.Errorf("error_type: expected *errors.errorString, got %v", m.Extra["error_type"])
+	}
+	if time.Since(m.Time()) > time.Minute {
+		t.Errorf("expected a timestamp of about now, got %s", m.Time())
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Validate: %s", err)
+	}
+
+	m = NewErrorMessage("h", stackError{"with stack"})
+	if m.Short != "with stack" || m.Full != "with stack\nmain.main\n\t/src/main.go:42" {
+		t.Errorf("expected the stack trace as full message, got %q", m.Full)
+	}
+}
+
+func TestMessageReset(t *testing.T) {
+	m := &Message{Version: "1.1", Host: "h", Short: "s", Level: 3, Line: 7,
+		Extra:     map[string]interface{}{"a": 1},
+		Unknown:   map[string]interface{}{"x": true},
+		RawExtra:  []byte(`{"b":2}`),
+		Transport: Transport{Chunked: true}}
+	extra := m.Extra
+
+	m.Reset()
+	if m.Version != "" || m.Short != "" || m.Level != 0 || m.Line != 0 || m.RawExtra != nil || m.Transport.Chunked {
+		t.Errorf("Reset left fields set: %+v", m)
+	}
+	if len(m.Extra) != 0 || len(m.Unknown) != 0 {
+		t.Errorf("Reset left entries in the maps: %+v", m)
+	}
+	extra["c"] = 3
+	if m.Extra["c"] != 3 {
+		t.Errorf("Reset didn't keep the Extra map")
+	}
+}
+
+func TestMessageIntegerTimestamp(t *testing.T) {
+	for name, ts := range map[string]interface{}{
+		"int":         int(1500000000),
+		"int64":       int64(1500000000),
+		"json.Number": json.Number("1500000000"),
+	} {
+		m := new(Message)
+		m.fromMap(map[string]interface{}{"version": "1.1", "host": "h", "short_message": "s", "timestamp": ts})
+		if m.TimeUnix != 1500000000 {
+			t.Errorf("%s: expected timestamp 1500000000, got %f", name, m.TimeUnix)
+		}
+	}
+
+	msg, err := DecodeMessage(strings.NewReader(`{"version":"1.1","host":"h","short_message":"s","timestamp":1500000000}`))
+	if err != nil {
+		t.Fatalf("DecodeMessage: %s", err)
+	}
+	if msg.TimeUnix != 1500000000 {
+		t.Errorf("expected timestamp 1500000000, got %f", msg.TimeUnix)
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	m := &Message{Version: "1.1", Host: "web1", Short: "disk full", Level: LevelError,
+		Extra: map[string]interface{}{"free": 0, "device": "sda1"}}
+	m.SetTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := "2024-01-02T03:04:05Z web1 ERROR disk full {device=sda1 free=0}"
+	if s := m.String(); s != expected {
+		t.Errorf("String: expected %q, got %q", expected, s)
+	}
+	if s := fmt.Sprint(m); s != expected {
+		t.Errorf("Sprint: expected %q, got %q", expected, s)
+	}
+
+	m = &Message{Host: "h", Short: "no time", Level: LevelInfo}
+	if s, expected := m.String(), "- h INFO no time"; s != expected {
+		t.Errorf("String: expected %q, got %q", expected, s)
+	}
+}
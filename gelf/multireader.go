@@ -0,0 +1,126 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MessageReader receives GELF messages.  Reader and TCPReader are both
+// MessageReaders.
+type MessageReader interface {
+	ReadMessage() (*Message, error)
+	Close() error
+}
+
+// SourceError is returned by MultiReader.ReadMessage for an error met
+// by one of its readers.
+type SourceError struct {
+	Source int // index of the reader in the arguments of NewMultiReader
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("source %d: %s", e.Source, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// MultiReader merges the messages of several readers, listening on
+// different addresses or transports, into a single stream.  Every
+// reader is read by a goroutine of its own, until it returns
+// ErrReaderClosed or io.EOF.
+type MultiReader struct {
+	readers []MessageReader
+	results chan readResult // closed once every reader is done
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// readResult is the outcome of a ReadMessage on one of the readers.
+type readResult struct {
+	msg *Message
+	err error
+}
+
+// NewMultiReader returns a MultiReader reading from readers, which it
+// owns from then on: they must not be read from elsewhere, and are
+// closed by its Close.
+func NewMultiReader(readers ...MessageReader) *MultiReader {
+	m := &MultiReader{
+		readers: readers,
+		results: make(chan readResult),
+		done:    make(chan struct{}),
+	}
+
+	m.wg.Add(len(readers))
+	for i, r := range readers {
+		go m.read(i, r)
+	}
+	go func() {
+		m.wg.Wait()
+		close(m.results)
+	}()
+
+	return m
+}
+
+// ReadMessage returns the next message received by any of the readers,
+// blocking until one arrives.  Errors are *SourceErrors telling which
+// reader met them.  Once the MultiReader is closed, or all its readers
+// are done, ReadMessage returns ErrReaderClosed.
+func (m *MultiReader) ReadMessage() (*Message, error) {
+	select {
+	case f, ok := <-m.results:
+		if !ok {
+			return nil, ErrReaderClosed
+		}
+		return f.msg, f.err
+	case <-m.done:
+		return nil, ErrReaderClosed
+	}
+}
+
+// Close closes all the readers, returning the first error doing so.
+func (m *MultiReader) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		for _, r := range m.readers {
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+		}
+		m.wg.Wait()
+	})
+	return err
+}
+
+func (m *MultiReader) read(i int, r MessageReader) {
+	defer m.wg.Done()
+
+	for {
+		msg, err := r.ReadMessage()
+		if err == ErrReaderClosed || err == io.EOF {
+			return
+		}
+
+		f := readResult{msg: msg}
+		if err != nil {
+			f = readResult{err: &SourceError{Source: i, Err: err}}
+		}
+
+		select {
+		case m.results <- f:
+		case <-m.done:
+			return
+		}
+	}
+}
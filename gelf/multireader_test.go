@@ -0,0 +1,62 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMultiReader(t *testing.T) {
+	udp, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	tcp, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	m := NewMultiReader(udp, tcp)
+	defer m.Close()
+
+	sendRaw(t, udp.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"over udp"}`))
+	w, err := NewTCPWriter(tcp.Addr())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "over tcp"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		msg, err := m.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		got[msg.Short] = true
+	}
+	if !got["over udp"] || !got["over tcp"] {
+		t.Errorf("expected a message from each reader, got %v", got)
+	}
+
+	sendRaw(t, udp.Addr(), []byte("not json"))
+	_, err = m.ReadMessage()
+	var serr *SourceError
+	if !errors.As(err, &serr) || serr.Source != 0 || !errors.Is(err, ErrJSONDecode) {
+		t.Errorf("expected a SourceError from reader 0, got %v", err)
+	}
+
+	if err = m.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err = m.ReadMessage(); err != ErrReaderClosed {
+		t.Errorf("ReadMessage after Close: expected ErrReaderClosed, got %v", err)
+	}
+	if _, err = udp.ReadMessage(); err != ErrReaderClosed {
+		t.Errorf("Close didn't close the readers: %v", err)
+	}
+}
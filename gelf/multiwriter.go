@@ -0,0 +1,79 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DestinationError is returned by MultiWriter.WriteMessage for an
+// error met by one of its writers.
+type DestinationError struct {
+	Destination int // index of the writer in the arguments of NewMultiWriter
+	Err         error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("destination %d: %s", e.Destination, e.Err)
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// MultiWriter sends every message to several writers, to ship the
+// same logs to more than one server.  Messages are written to each
+// writer in turn, on the caller's goroutine, so a Writer that is slow
+// to send holds up the others; AsyncWriters, which only queue the
+// message, keep the destinations from waiting on each other.  A writer
+// failing doesn't keep the message from being sent to the others.
+type MultiWriter struct {
+	writers []MessageWriter
+}
+
+// NewMultiWriter returns a MultiWriter sending to writers, which are
+// usually Writers or AsyncWriters, and which its Close closes.
+func NewMultiWriter(writers ...MessageWriter) *MultiWriter {
+	return &MultiWriter{writers: writers}
+}
+
+// WriteMessage sends m to every writer, and returns the errors met,
+// each as a *DestinationError, joined into a single error.  m must not
+// be modified while an AsyncWriter may still be marshaling it.
+func (mw *MultiWriter) WriteMessage(m *Message) error {
+	var errs []error
+	for i, w := range mw.writers {
+		// tell the writers who called us, rather than us
+		wm := m
+		if cw, ok := w.(interface {
+			withCaller(m *Message, depth int) *Message
+		}); ok {
+			wm = cw.withCaller(m, 1)
+		}
+
+		if err := w.WriteMessage(wm); err != nil {
+			errs = append(errs, &DestinationError{Destination: i, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every writer that has a Close method, and returns the
+// errors met, as WriteMessage does.
+func (mw *MultiWriter) Close() error {
+	var errs []error
+	for i, w := range mw.writers {
+		c, ok := w.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			errs = append(errs, &DestinationError{Destination: i, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
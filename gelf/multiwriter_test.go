@@ -0,0 +1,52 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMultiWriter(t *testing.T) {
+	w1, r1, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r1.Close()
+	w2, r2, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r2.Close()
+	w2.SetCallerInfo(0)
+
+	// the broken writer in the middle doesn't stop the last one
+	broken := &Writer{tcp: &tcpTransport{state: StateClosed}}
+	mw := NewMultiWriter(w1, broken, w2)
+
+	err = mw.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "tee"})
+	var destErr *DestinationError
+	if !errors.As(err, &destErr) || destErr.Destination != 1 || !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("WriteMessage: expected ErrWriterClosed from destination 1, got %v", err)
+	}
+
+	for i, r := range []*Reader{r1, r2} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage %d: %s", i, err)
+		}
+		if msg.Short != "tee" {
+			t.Errorf("reader %d: msg.Short: expected tee, got %q", i, msg.Short)
+		}
+		if i == 1 && !strings.HasSuffix(msg.File, "multiwriter_test.go") {
+			t.Errorf("msg.File: expected the caller of WriteMessage, got %q", msg.File)
+		}
+	}
+
+	if err = NewMultiWriter(w1, w2).Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+}
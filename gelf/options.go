@@ -0,0 +1,243 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// ReaderOption configures a Reader at construction time.
+type ReaderOption func(*Reader) error
+
+// OverflowPolicy decides what happens to a message that is ready to
+// be delivered while the buffer it should go to is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the buffer, pushing back on
+	// whatever produces the messages.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the message and counts it as
+	// dropped.
+	OverflowDropNewest
+)
+
+// ReservedFieldPolicy decides what a Reader does with the "_id"
+// field, which GELF reserves, when a message has it anyway.
+type ReservedFieldPolicy int
+
+const (
+	// ReservedDrop removes the field.
+	ReservedDrop ReservedFieldPolicy = iota
+	// ReservedRename renames it, as Message.SanitizeExtras does.
+	ReservedRename
+	// ReservedKeep leaves it in Message.Extra, as "id".
+	ReservedKeep
+)
+
+// Capacity of the channels returned by Reader.Messages and
+// Reader.Errors, unless set with WithMessageBuffer.
+const defaultMessageBuffer = 64
+
+// WithMessageBuffer sets the capacity of the channels returned by
+// Messages and Errors, and what to do with messages received while
+// the consumer is too slow to leave room in the buffer for them.
+func WithMessageBuffer(size int, policy OverflowPolicy) ReaderOption {
+	return func(r *Reader) error {
+		if size < 0 {
+			return fmt.Errorf("invalid message buffer size %d", size)
+		}
+		if policy != OverflowBlock && policy != OverflowDropNewest {
+			return fmt.Errorf("unknown overflow policy %d", policy)
+		}
+		r.bufferSize = size
+		r.overflow = policy
+		return nil
+	}
+}
+
+// WithMaxMessages makes the loop behind Messages stop after n
+// messages, closing the Messages and Errors channels; the chunks of
+// messages still being reassembled are discarded.  By default, or
+// with n zero, it goes on until the reader is closed, which it still
+// has to be.
+func WithMaxMessages(n int) ReaderOption {
+	return func(r *Reader) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max messages %d", n)
+		}
+		r.maxMessages = n
+		return nil
+	}
+}
+
+// WithIdleTimeout makes the loop behind Messages stop, as with
+// WithMaxMessages, once no message or error was received for d.
+// Zero, the default, waits forever.
+func WithIdleTimeout(d time.Duration) ReaderOption {
+	return func(r *Reader) error {
+		if d < 0 {
+			return fmt.Errorf("invalid idle timeout %s", d)
+		}
+		r.idleTimeout = d
+		return nil
+	}
+}
+
+// WithDecodeWorkers makes the loop behind Messages decode messages on
+// n goroutines, so that a large message, slow to decompress and
+// parse, doesn't hold up the reading of the others while the socket's
+// buffer fills up: one goroutine receives datagrams and reassembles
+// chunked messages, and hands them to the workers, which deliver them
+// as soon as they are decoded.  Messages may then be delivered out of
+// order, but none is lost but as the overflow policy and
+// WithMaxMessages say.  By default, messages are decoded by the
+// reading goroutine, one at a time.
+func WithDecodeWorkers(n int) ReaderOption {
+	return func(r *Reader) error {
+		if n < 1 {
+			return fmt.Errorf("invalid decode workers %d", n)
+		}
+		r.decodeWorkers = n
+		return nil
+	}
+}
+
+// WithReadBufferSize sets the size of the operating system's receive
+// buffer for the reader's socket.  Collectors receiving bursts of
+// datagrams drop them once this buffer fills up.  The kernel may cap
+// the size actually used; on Linux the limit is net.core.rmem_max.
+func WithReadBufferSize(bytes int) ReaderOption {
+	return func(r *Reader) error {
+		if bytes <= 0 {
+			return fmt.Errorf("invalid read buffer size %d", bytes)
+		}
+		r.readBufferSize = bytes
+		return nil
+	}
+}
+
+// WithReusePort sets SO_REUSEPORT on a UDP reader's socket before
+// binding it, so that several readers, in one process or many, can
+// listen on the same port, every one of them binding it with
+// WithReusePort.  The kernel then spreads the datagrams across them,
+// by sender address, so the chunks of a message all reach the same
+// reader.  Load balancing UDP this way needs Linux 3.9 or later; other
+// BSD-derived systems accept the option but may deliver every datagram
+// to the last reader bound.  On systems without SO_REUSEPORT, the
+// reader fails to open.
+func WithReusePort() ReaderOption {
+	return func(r *Reader) error {
+		if !reusePortSupported {
+			return fmt.Errorf("WithReusePort: SO_REUSEPORT is not supported on this platform")
+		}
+		r.reusePort = true
+		return nil
+	}
+}
+
+// WithMaxDatagramSize sets the largest datagram the reader accepts,
+// chunk header included; larger ones are rejected with
+// ErrDatagramTooLarge.  The default, ChunkSize, is the chunk size of
+// Writer, but a Writer given a larger SetChunkSize, or other senders,
+// may use larger chunks, like 8192 bytes, or send large messages
+// unchunked.  Up to 65507 bytes, the most a UDP datagram can hold, may
+// be set.  Every chunk of a message being reassembled takes up a
+// buffer of this size.
+func WithMaxDatagramSize(n int) ReaderOption {
+	return func(r *Reader) error {
+		if n <= chunkedHeaderLen || n > maxChunkSize {
+			return fmt.Errorf("invalid max datagram size %d", n)
+		}
+		r.maxDatagramSize = n
+		return nil
+	}
+}
+
+// WithMaxChunks sets the most chunks a chunked message may have, from
+// 1 to 255; the default is the 128 of the GELF spec.  Chunks of larger
+// messages are rejected with ErrTooManyChunks without being buffered,
+// which bounds the memory a single message can take up while it is
+// reassembled.
+func WithMaxChunks(n int) ReaderOption {
+	return func(r *Reader) error {
+		if n < 1 || n > 255 {
+			return fmt.Errorf("invalid max chunks %d", n)
+		}
+		r.maxChunks = n
+		return nil
+	}
+}
+
+// WithMaxPendingMessages sets the most chunked messages the reader
+// reassembles at once; the default is 1024.  The first chunk of
+// another message makes the reader drop the one that has been waiting
+// for its remaining chunks the longest, counting it as incomplete, so
+// that chunks of messages that never complete, forged or lost, can't
+// pile up.
+func WithMaxPendingMessages(n int) ReaderOption {
+	return func(r *Reader) error {
+		if n < 1 {
+			return fmt.Errorf("invalid max pending messages %d", n)
+		}
+		r.maxPending = n
+		return nil
+	}
+}
+
+// WithMaxPendingBytes sets the most memory, in bytes, the chunks of
+// the messages being reassembled may take up together; the default is
+// 32 MiB.  Past it, the messages that have been waiting the longest
+// are dropped, as with WithMaxPendingMessages, the one the last chunk
+// belongs to included if it alone is over the limit.
+func WithMaxPendingBytes(n int) ReaderOption {
+	return func(r *Reader) error {
+		if n < 1 {
+			return fmt.Errorf("invalid max pending bytes %d", n)
+		}
+		r.maxPendingBytes = n
+		return nil
+	}
+}
+
+// WithReassemblyKey sets how the chunks of a message are told apart
+// from those of other messages while it is reassembled: chunks for
+// which key returns the same string belong to the same message.  By
+// default, the key is the message id alone, and a chunk with the id of
+// a message from another sender is rejected with ErrOutOfBandMessage;
+// keying on the sender's address as well keeps messages from different
+// senders apart even if their ids collide.  key must not retain
+// chunkID, which is only valid during the call.
+func WithReassemblyKey(key func(addr net.Addr, chunkID []byte) string) ReaderOption {
+	return func(r *Reader) error {
+		r.reassemblyKey = key
+		return nil
+	}
+}
+
+// WithRawDeflate makes the reader decode the messages some senders
+// compress with raw DEFLATE, without the zlib header: having no magic
+// bytes, they are taken for uncompressed messages, and retried as
+// DEFLATE once they fail to decode as JSON.  Only those failing
+// messages pay for the retry.
+func WithRawDeflate() ReaderOption {
+	return func(r *Reader) error {
+		r.dec.rawDeflate = true
+		return nil
+	}
+}
+
+// WithDecompressor makes the reader recognize and decompress another
+// compression format, besides the built-in gzip and zlib.  Gzip is
+// detected first, then the formats added with WithDecompressor, in
+// the order they were added, then zlib.
+func WithDecompressor(d Decompressor) ReaderOption {
+	return func(r *Reader) error {
+		r.dec.decompressors = append(r.dec.decompressors, d)
+		return nil
+	}
+}
@@ -5,42 +5,353 @@
 package gelf
 
 import (
-	"bytes"
-	"compress/gzip"
-	"compress/zlib"
+	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
-	"strings"
+	"os"
 	"sync"
+	"time"
 )
 
+var (
+	// ErrReaderClosed is returned by reads on a Reader that has
+	// been closed, including reads that were blocked when Close
+	// was called.
+	ErrReaderClosed = errors.New("reader closed")
+
+	// ErrInvalidChunkHeader is returned when a datagram starts
+	// with the chunked magic bytes but is too short to hold a
+	// chunk header, or its sequence number isn't below its total.
+	ErrInvalidChunkHeader = errors.New("invalid chunk header")
+
+	// ErrMessageTooLarge is returned when a message decompresses
+	// to more than the reader's maximum decompressed size.
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// ErrDatagramTooLarge is returned when a datagram is larger
+	// than the reader's maximum datagram size, rather than reading
+	// it truncated.
+	ErrDatagramTooLarge = errors.New("datagram too large")
+
+	// ErrTooManyChunks is returned when a chunk claims its message
+	// has more chunks than the reader accepts.
+	ErrTooManyChunks = errors.New("too many chunks")
+
+	// ErrInconsistentChunks is returned when a chunk's total doesn't
+	// match that of the chunks of the same message received before.
+	ErrInconsistentChunks = errors.New("inconsistent chunks")
+
+	// ErrMissingChunk is returned by DecodeMessage when the chunks
+	// it is given lack one of the message's.
+	ErrMissingChunk = errors.New("missing chunk")
+
+	// ErrOutOfBandMessage is returned when a chunk comes from
+	// another sender than the first chunk of its message.
+	ErrOutOfBandMessage = errors.New("out-of-band message")
+
+	// ErrDecompress is returned, wrapping the error of the
+	// decompressor, when a message can't be decompressed.
+	ErrDecompress = errors.New("cannot decompress message")
+
+	// ErrJSONDecode is returned, wrapping the error of the JSON
+	// decoder, when a message isn't a valid JSON object.
+	ErrJSONDecode = errors.New("cannot decode message JSON")
+)
+
+// How long the chunks of an incomplete message are kept around,
+// waiting for the rest to arrive.  Graylog uses the same limit.
+const defaultReassemblyTimeout = 5 * time.Second
+
+// The most chunks a message may have, as the GELF spec says, unless
+// changed with WithMaxChunks.
+const defaultMaxChunks = 128
+
+// The most chunked messages reassembled at once, and the most memory
+// their chunks may take up, unless changed with WithMaxPendingMessages
+// and WithMaxPendingBytes.
+const (
+	defaultMaxPendingMessages = 1024
+	defaultMaxPendingBytes    = 32 << 20
+)
+
+// Reader receives GELF messages from a datagram socket.  Its methods
+// may be called from several goroutines at once: concurrent reads are
+// serialized, each call getting a whole message of its own.  Deadlines
+// are those of the underlying connection, shared by all readers, so a
+// ReadMessageContext being cancelled may interrupt another goroutine's
+// read as well.
 type Reader struct {
-	mu   sync.Mutex
-	conn net.Conn
+	mu     sync.Mutex
+	readMu sync.Mutex // held while reading a message
+	conn   net.Conn
+	buf    []byte // undelivered remainder of the last message handed to Read
+	closed bool
+
+	socketPath string // Unix socket file to remove on Close
+
+	// socket settings made by options, applied once it's open
+	readBufferSize int
+	reusePort      bool
+
+	// chunked messages being reassembled, keyed by reassemblyKey
+	chunkSets         map[string]*chunkSet
+	chunkOrder        list.List // of the chunkSets, by arrival of their first chunk
+	pendingBytes      int       // held by the chunkSets
+	maxPending        int
+	maxPendingBytes   int
+	reassemblyKey     func(addr net.Addr, chunkID []byte) string // nil for the id alone
+	bufPool           sync.Pool                                  // of *[]byte, holding maxDatagramSize+1 buffers
+	maxDatagramSize   int
+	reassemblyTimeout time.Duration
+	maxChunks         int
+	chunkParser       ChunkHeaderParser
+
+	dec           decoder
+	flattenExtras bool
+	keepPrefix    bool
+	strict        bool
+	reserved      ReservedFieldPolicy
+	minLevel      int32 // no filtering if negative
+	specVersion   string
+	version       string // of messages without one, if set
+	errorHandler  func(raw []byte, err error)
+
+	// state of the Messages/Errors delivery loop
+	done          chan struct{} // closed by Close
+	loopOnce      sync.Once
+	messages      chan *Message
+	errs          chan error
+	bufferSize    int
+	overflow      OverflowPolicy
+	maxMessages   int           // no limit if zero
+	idleTimeout   time.Duration // none if zero
+	decodeWorkers int           // decoding inline if zero
+
+	counters        readerCounters
+	expvarNamespace string // to publish counters under, once open
+}
+
+// chunkSet accumulates the chunks of a single chunked message.  Its
+// chunks are first kept in a buffer each.  Senders split a message
+// into chunks of a single size, but for the last one, so once half of
+// them are in, buf is made to fit the whole message, and every payload
+// is copied straight to its place in it; making it any sooner would
+// let a single forged chunk take up the memory of a whole message.  A
+// chunk of another size makes the set keep a buffer per chunk to the
+// end, to be concatenated once they are all in.
+type chunkSet struct {
+	key       string
+	elem      *list.Element // in Reader.chunkOrder
+	total     int
+	seen      [4]uint64 // bitmap of the sequence numbers received
+	got       int
+	length    int
+	held      int       // bytes of buffers, as counted in Reader.pendingBytes
+	buf       []byte    // total*chunkLen bytes, once half the chunks are in
+	chunkLen  int       // of the chunks but the last, once buf is made
+	lastLen   int       // of the last chunk, once it is in buf
+	chunks    []*[]byte // chunk payloads, until buf is made, in buffers from Reader.bufPool
+	scattered bool      // if the chunks differ in size, and never go to buf
+	first     time.Time // arrival of the first chunk
+	addr      net.Addr  // sender of the first chunk
+}
+
+func (set *chunkSet) has(seq int) bool {
+	return set.seen[seq/64]&(1<<(seq%64)) != 0
+}
+
+// NewReader listens for GELF messages on the UDP address addr.  An
+// address without a host, like ":12201", listens on every local
+// address: on systems with dual-stack sockets, the default on Linux
+// and Windows, that includes both IPv4 and IPv6, and Addr reports the
+// IPv6 wildcard "[::]:12201".  A host name is resolved to a single
+// address, which may be of either family.  NewReader4 and NewReader6
+// restrict the reader to one family.
+func NewReader(addr string, opts ...ReaderOption) (*Reader, error) {
+	return newUDPReader("udp", addr, opts)
+}
+
+// NewReader4 is like NewReader, but only listens on IPv4.
+func NewReader4(addr string, opts ...ReaderOption) (*Reader, error) {
+	return newUDPReader("udp4", addr, opts)
+}
+
+// NewReader6 is like NewReader, but only listens on IPv6.
+func NewReader6(addr string, opts ...ReaderOption) (*Reader, error) {
+	return newUDPReader("udp6", addr, opts)
 }
 
-func NewReader(addr string) (*Reader, error) {
-	var err error
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+func newUDPReader(network, addr string, opts []ReaderOption) (*Reader, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("ResolveUDPAddr('%s'): %s", addr, err)
 	}
 
-	conn, err := net.ListenUDP("udp", udpAddr)
+	r, err := configureReader(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if r.reusePort {
+		conn, err = listenUDPReusePort(network, udpAddr)
+	} else {
+		conn, err = net.ListenUDP(network, udpAddr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ListenUDP: %s", err)
 	}
 
+	if err = r.setConn(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewUnixgramReader listens for GELF messages on the Unix datagram
+// socket at path, which is removed when the reader is closed.
+func NewUnixgramReader(path string, opts ...ReaderOption) (*Reader, error) {
+	unixAddr, err := net.ResolveUnixAddr("unixgram", path)
+	if err != nil {
+		return nil, fmt.Errorf("ResolveUnixAddr('%s'): %s", path, err)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", unixAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ListenUnixgram: %s", err)
+	}
+
+	r, err := newReader(conn, opts)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	r.socketPath = path
+
+	return r, nil
+}
+
+// NewReaderFromConn returns a Reader receiving GELF messages on conn,
+// a socket opened by the caller: inherited through systemd socket
+// activation, for instance, or with options the package doesn't set.
+// The reader owns conn from then on, and closes it on Close.
+func NewReaderFromConn(conn net.PacketConn, opts ...ReaderOption) (*Reader, error) {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		c = packetConn{conn}
+	}
+	return newReader(c, opts)
+}
+
+// NewReaderFromNetConn is like NewReaderFromConn, for a connection
+// that is not a net.PacketConn, such as a connected socket or an
+// in-memory pipe.  Every Read must return a single datagram, which is
+// taken to come from conn's remote address.
+func NewReaderFromNetConn(conn net.Conn, opts ...ReaderOption) (*Reader, error) {
+	return newReader(conn, opts)
+}
+
+// packetConn lets a net.PacketConn that isn't a net.Conn be a Reader's
+// connection, which is only ever read with ReadFrom.
+type packetConn struct {
+	net.PacketConn
+}
+
+func (c packetConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c packetConn) Write(b []byte) (int, error) {
+	return 0, errors.New("gelf: write to a reader's connection")
+}
+
+func (c packetConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// newReader sets up a Reader receiving datagrams on conn.  conn is
+// closed if one of the options fails.
+func newReader(conn net.Conn, opts []ReaderOption) (*Reader, error) {
+	r, err := configureReader(opts)
+	if err == nil {
+		err = r.setConn(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// configureReader returns a Reader with the defaults changed by opts,
+// but no socket yet.
+func configureReader(opts []ReaderOption) (*Reader, error) {
 	r := new(Reader)
-	r.conn = conn
+	r.chunkSets = make(map[string]*chunkSet)
+	r.bufPool.New = func() interface{} {
+		// one more byte than allowed, to tell a datagram of the
+		// maximum size from a larger one truncated to fit
+		b := make([]byte, r.maxDatagramSize+1)
+		return &b
+	}
+	r.reassemblyTimeout = defaultReassemblyTimeout
+	r.maxChunks = defaultMaxChunks
+	r.maxPending = defaultMaxPendingMessages
+	r.maxPendingBytes = defaultMaxPendingBytes
+	r.maxDatagramSize = ChunkSize
+	r.minLevel = -1
+	r.dec = newDecoder()
+	r.chunkParser = gelfChunkHeader{}
+	r.done = make(chan struct{})
+	r.bufferSize = defaultMessageBuffer
+
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
 
 	return r, nil
 }
 
+// setConn makes conn the reader's socket, applying the socket
+// settings of its options.
+func (r *Reader) setConn(conn net.Conn) error {
+	if r.reusePort {
+		if _, ok := conn.(*net.UDPConn); !ok {
+			return fmt.Errorf("WithReusePort: unsupported connection %T", conn)
+		}
+	}
+	if r.readBufferSize > 0 {
+		c, ok := conn.(interface{ SetReadBuffer(int) error })
+		if !ok {
+			return fmt.Errorf("WithReadBufferSize: unsupported connection %T", conn)
+		}
+		if err := c.SetReadBuffer(r.readBufferSize); err != nil {
+			return fmt.Errorf("SetReadBuffer(%d): %s", r.readBufferSize, err)
+		}
+	}
+
+	if err := r.publishExpvar(); err != nil {
+		return err
+	}
+	r.conn = conn
+	return nil
+}
+
+// Addr returns the address the reader is bound to, of the family it
+// actually listens on, or "" once it is closed.
 func (r *Reader) Addr() string {
+	if r.conn == nil || r.isClosed() {
+		return ""
+	}
 	return r.conn.LocalAddr().String()
 }
 
@@ -48,191 +359,821 @@ func (r *Reader) GetConnection() net.Conn {
 	return r.conn
 }
 
-// FIXME: this will discard data if p isn't big enough to hold the
-// full message.
+// UDPConn returns the reader's UDP socket, to set socket options the
+// package doesn't have setters for, through its SyscallConn.  It
+// returns false for readers that don't receive from UDP.  Reading from
+// the socket directly takes datagrams away from the reader.
+func (r *Reader) UDPConn() (*net.UDPConn, bool) {
+	c, ok := r.conn.(*net.UDPConn)
+	return c, ok
+}
+
+// Close releases the reader's socket.  Any ReadMessage blocked on it
+// returns ErrReaderClosed, as do all reads made afterwards.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+
+	err := r.conn.Close()
+	if r.socketPath != "" {
+		os.Remove(r.socketPath)
+	}
+
+	return err
+}
+
+// SetReassemblyTimeout sets how long the chunks of a message are
+// kept after the first of them arrives.  If the remaining chunks
+// haven't all arrived by then, the message is dropped.  A timeout of
+// zero keeps incomplete messages until the next read error.  The
+// default is 5 seconds, as in Graylog.
+func (r *Reader) SetReassemblyTimeout(d time.Duration) {
+	r.reassemblyTimeout = d
+}
+
+// SetMaxDecompressedSize sets the largest size, in bytes, a message
+// may have once decompressed.  Reading a message that inflates past
+// it fails with ErrMessageTooLarge.  A size of zero or less removes
+// the limit.  The default is 16 MiB.
+func (r *Reader) SetMaxDecompressedSize(n int64) {
+	r.dec.maxDecompressedSize = n
+}
+
+// SetFlattenExtras makes the reader flatten the objects and arrays
+// found in extra fields, which GELF doesn't allow but some senders
+// use anyway.  Every value nested in an object gets its own extra
+// field, named by joining the names of the enclosing fields and its
+// own with dots: {"_a": {"b": 1, "c": {"d": 2}}} becomes the extra
+// fields "a.b" and "a.c.d".  Array elements are named after their
+// index, so {"_tags": ["x", "y"]} becomes "tags.0" and "tags.1".
+// Empty objects and arrays disappear.  A field already named that
+// way wins over a flattened one, like "a.b" in {"_a.b": 1, "_a":
+// {"b": 2}}.
+func (r *Reader) SetFlattenExtras(flatten bool) {
+	r.flattenExtras = flatten
+}
+
+// SetKeepExtraPrefix makes the reader keep the leading underscore of
+// additional fields in Message.Extra, as in "_user_id", instead of
+// stripping it, so that messages are forwarded with the fields they
+// came with.  Fields the reader adds itself, like those of
+// SetFlattenExtras, get one too.
+func (r *Reader) SetKeepExtraPrefix(keep bool) {
+	r.keepPrefix = keep
+}
+
+// SetDecoderFunc sets the function creating the json.Decoder each
+// message is decoded with, from a reader of its decompressed JSON.
+// The decoder only ever decodes into a map[string]interface{}, so
+// UseNumber matters most: without it, numbers become float64.  A nil
+// f restores the default, a json.NewDecoder using UseNumber.
+func (r *Reader) SetDecoderFunc(f func(io.Reader) *json.Decoder) {
+	r.dec.decoderFunc = f
+}
+
+// SetJSONCodec makes r decode messages with c instead of
+// encoding/json, taking precedence over SetDecoderFunc.  A nil c
+// restores encoding/json.
+func (r *Reader) SetJSONCodec(c JSONCodec) {
+	r.dec.codec = c
+}
+
+// SetZlibDictionary sets the preset dictionary zlib messages were
+// compressed with, by a Writer given the same one with
+// Writer.SetZlibDictionary.  Messages compressed without a dictionary
+// still decode; those compressed with another one, or read without
+// it, fail with ErrDecompress.  A nil dict removes the dictionary.
+func (r *Reader) SetZlibDictionary(dict []byte) {
+	if len(dict) == 0 {
+		r.dec.zlibDict = nil
+		return
+	}
+	r.dec.zlibDict = append([]byte(nil), dict...)
+}
+
+// SetStrict makes ReadMessage check every message with
+// Message.Validate, returning the error instead of an invalid message.
+func (r *Reader) SetStrict(strict bool) {
+	r.strict = strict
+}
+
+// SetMinLevel makes ReadMessage skip the messages less severe than
+// level, reading on until it gets one at least as severe.  Severity
+// goes the other way from the level number, as in syslog: with
+// SetMinLevel(LevelWarning), messages of levels 0 (LevelEmergency) to
+// 4 (LevelWarning) are returned, and those of levels 5 (LevelNotice)
+// and above are skipped.  A negative level, the default, turns the
+// filter off.
+func (r *Reader) SetMinLevel(level int32) {
+	r.minLevel = level
+}
+
+// SetReservedFields sets what ReadMessage does with an "_id" field,
+// which GELF reserves: by default, ReservedDrop removes it from the
+// message.  With ReservedKeep, a strict reader rejects the message.
+func (r *Reader) SetReservedFields(policy ReservedFieldPolicy) error {
+	switch policy {
+	case ReservedDrop, ReservedRename, ReservedKeep:
+		r.reserved = policy
+		return nil
+	}
+	return fmt.Errorf("unknown reserved field policy %d", policy)
+}
+
+// SetSpecVersion sets which version of GELF the Reader follows for
+// the "facility" field.  GELF 1.0 made facility, file and line
+// standard fields; GELF 1.1 deprecated them, sending facility as the
+// additional field "_facility" instead.  Either way, a top-level
+// facility is decoded into Message.Facility, and file and line into
+// File and Line.  With "1.1", a top-level facility is also copied into
+// Extra["facility"], unless the message has that field already, so
+// that code reading 1.1 messages finds it whichever way it was sent.
+// "auto" does so only for messages whose version is "1.1", and "1.0",
+// the default, never does.
+func (r *Reader) SetSpecVersion(version string) error {
+	switch version {
+	case "1.0", "1.1", "auto":
+		r.specVersion = version
+		return nil
+	}
+	return fmt.Errorf("unknown GELF version %q", version)
+}
+
+// SetDefaultVersion makes ReadMessage set the Version of messages that
+// have none, or an empty one, to version, "1.1" or "1.0", so that they
+// pass Validate and SetStrict.  The JSON returned by ReadMessageRaw is
+// left as it was received.  An empty version, the default, leaves
+// Version empty.
+func (r *Reader) SetDefaultVersion(version string) error {
+	switch version {
+	case "", "1.0", "1.1":
+		r.version = version
+		return nil
+	}
+	return fmt.Errorf("unsupported GELF version %q", version)
+}
+
+// mirrorFacility copies msg.Facility into msg.Extra, as SetSpecVersion
+// describes.
+func (r *Reader) mirrorFacility(msg *Message) {
+	if msg.Facility == "" || r.specVersion == "" || r.specVersion == "1.0" {
+		return
+	}
+	if r.specVersion == "auto" && msg.Version != "1.1" {
+		return
+	}
+	if _, ok := msg.Extra["facility"]; ok {
+		return
+	}
+
+	if msg.Extra == nil {
+		msg.Extra = make(map[string]interface{}, 1)
+	}
+	msg.Extra["facility"] = msg.Facility
+}
+
+// SetErrorHandler makes ReadMessage hand the messages that fail to
+// decompress or decode to f, with the error, and read on, instead of
+// returning the error.  raw is the message decompressed, if that much
+// worked, or else as received, reassembled from its chunks; f may keep
+// it.  f is called by the goroutine reading, or, for a reader made
+// WithDecodeWorkers, by the decoding workers concurrently, and must
+// then be safe for concurrent use.  A nil f, the default, makes
+// ReadMessage return decoding errors again.
+func (r *Reader) SetErrorHandler(f func(raw []byte, err error)) {
+	r.errorHandler = f
+}
+
+// DiscardedPartials returns the number of chunked messages that were
+// dropped because not all of their chunks arrived.
+func (r *Reader) DiscardedPartials() uint64 {
+	return r.counters.incomplete.Load()
+}
+
+func (r *Reader) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closed
+}
+
+// Read implements io.Reader.  Each message contributes its full
+// message (or its short message, if the full one is empty) to the
+// stream.  If p is too small to hold the whole message, the rest is
+// kept and returned by subsequent calls before the next message is
+// read from the wire.
 func (r *Reader) Read(p []byte) (int, error) {
-	msg, err := r.ReadMessage()
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	r.mu.Lock()
+	for len(r.buf) == 0 {
+		// don't hold the lock while blocked on the network, so
+		// that Close can interrupt us
+		r.mu.Unlock()
+		msg, err := r.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		r.mu.Lock()
+		if msg.Full == "" {
+			r.buf = append(r.buf, msg.Short...)
+		} else {
+			r.buf = append(r.buf, msg.Full...)
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.mu.Unlock()
+
+	return n, nil
+}
+
+// SetReadDeadline sets the deadline for future reads on the
+// underlying connection, as net.Conn.SetReadDeadline does.  A zero
+// value disables the deadline.
+func (r *Reader) SetReadDeadline(t time.Time) error {
+	return r.conn.SetReadDeadline(t)
+}
+
+// ReadMessageContext is like ReadMessage, but gives up when ctx is
+// cancelled or its deadline passes, returning ctx.Err().  That holds
+// between the chunks of a message as well: the deadline applies to
+// every datagram read, and cancelling makes the pending read fail at
+// once.  Chunks of a message that had not been fully received by then
+// are discarded.  Any deadline set with SetReadDeadline is cleared on
+// return.
+func (r *Reader) ReadMessageContext(ctx context.Context) (*Message, error) {
+	var msg *Message
+	err := r.readContext(ctx, func() (err error) {
+		msg, err = r.ReadMessage()
+		return err
+	})
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
+	return msg, nil
+}
 
-	var data string
+// readContext calls read, making it give up as ReadMessageContext
+// does.
+func (r *Reader) readContext(ctx context.Context, read func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if msg.Full == "" {
-		data = msg.Short
-	} else {
-		data = msg.Full
+	deadline, _ := ctx.Deadline()
+	if err := r.conn.SetReadDeadline(deadline); err != nil {
+		if r.isClosed() {
+			return ErrReaderClosed
+		}
+		return fmt.Errorf("SetReadDeadline: %s", err)
 	}
 
-	return strings.NewReader(data).Read(p)
+	// wake up the blocked read as soon as the context is cancelled
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			r.conn.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err := read()
+
+	close(stop)
+	<-stopped
+	r.conn.SetReadDeadline(time.Time{})
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// the socket may time out a hair before ctx notices its
+		// deadline has passed
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
 }
 
 func (r *Reader) ReadMessage() (msg *Message, err error) {
-	var (
-		mapped map[string]interface{}
-		extra  map[string]interface{} = make(map[string]interface{})
-	)
+	msg, _, err = r.ReadMessageFrom()
+	return msg, err
+}
+
+// ReadMessageFrom is like ReadMessage, but also returns the address
+// the message was sent from.  For a chunked message, that's the
+// sender of its chunks, which must all come from the same address.
+// The address is nil for readers that don't receive from UDP.
+func (r *Reader) ReadMessageFrom() (*Message, *net.UDPAddr, error) {
+	return r.readMessage(nil, nil)
+}
 
-	mapped, err = r.readToMap()
+// ReadMessageInto is like ReadMessage, but decodes the message into m,
+// after resetting it, instead of allocating a new one.  The maps of m
+// are reused too, so their contents are only valid until the next
+// ReadMessageInto with m.
+func (r *Reader) ReadMessageInto(m *Message) error {
+	m.Reset()
+	_, _, err := r.readMessage(m, nil)
+	return err
+}
 
+// ReadMessageRaw is like ReadMessage, but also returns the JSON the
+// message was decoded from, decompressed and reassembled from its
+// chunks.  The JSON is a copy the caller may keep.  Getting it costs
+// an extra copy of every message, which ReadMessage avoids.
+func (r *Reader) ReadMessageRaw() (*Message, []byte, error) {
+	var raw []byte
+	msg, _, err := r.readMessage(nil, &raw)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return msg, raw, nil
+}
 
-	msg = new(Message)
+// readMessage reads the next message into msg, or a new Message if msg
+// is nil, storing its JSON in raw if raw isn't nil.
+func (r *Reader) readMessage(msg *Message, raw *[]byte) (*Message, *net.UDPAddr, error) {
+	// the reassembly state and the socket are read by one goroutine
+	// at a time; mu isn't used, so that Close can't wait on a read
+	var transport Transport
+	r.readMu.Lock()
+	mapped, from, err := r.readToMap(raw, &transport)
+	for err == errHandled || err == nil && r.skipLevel(mapped) {
+		mapped, from, err = r.readToMap(raw, &transport)
+	}
+	r.readMu.Unlock()
 
-	if val, ok := mapped["version"]; ok && val != nil {
-		msg.Version = val.(string)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if val, ok := mapped["host"]; ok && val != nil {
-		msg.Host = val.(string)
+	addr, _ := from.(*net.UDPAddr)
+	if msg, err = r.toMessage(msg, mapped, transport); err != nil {
+		return nil, nil, err
 	}
+	return msg, addr, nil
+}
 
-	if val, ok := mapped["short_message"]; ok && val != nil {
-		msg.Short = val.(string)
+// toMessage sets msg, or a new Message if it is nil, from the decoded
+// message mapped, applying the reader's settings.
+func (r *Reader) toMessage(msg *Message, mapped map[string]interface{}, transport Transport) (*Message, error) {
+	if msg == nil {
+		msg = new(Message)
+	}
+	msg.fromMap(mapped)
+	msg.Transport = transport
+	if r.flattenExtras {
+		msg.Extra = flattenExtra(msg.Extra)
+	}
+	if msg.Version == "" {
+		msg.Version = r.version
+	}
+	r.mirrorFacility(msg)
+	switch r.reserved {
+	case ReservedDrop:
+		msg.dropReserved()
+	case ReservedRename:
+		msg.SanitizeExtras()
+	}
+	if r.keepPrefix && len(msg.Extra) > 0 {
+		msg.Extra = prefixExtra(msg.Extra)
+	}
+	if r.strict {
+		if err := msg.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid message: %w", err)
+		}
 	}
 
-	if val, ok := mapped["full_message"]; ok && val != nil {
-		v := val.(string)
+	return msg, nil
+}
 
-		if len(v) > 0 {
-			msg.Full = v
-		}
+// skipLevel reports whether the decoded message is filtered out by
+// SetMinLevel.
+func (r *Reader) skipLevel(mapped map[string]interface{}) bool {
+	if r.minLevel < 0 {
+		return false
+	}
+
+	level, _ := int32Field(mapped["level"])
+	return level > r.minLevel
+}
+
+// readFrom reads a single datagram into b.  A connection that isn't a
+// net.PacketConn only ever receives from its remote address.
+func (r *Reader) readFrom(b []byte) (int, net.Addr, error) {
+	if pc, ok := r.conn.(net.PacketConn); ok {
+		return pc.ReadFrom(b)
+	}
+	n, err := r.conn.Read(b)
+	return n, r.conn.RemoteAddr(), err
+}
+
+// readToMap reads the next message and decodes it, also returning
+// the address it was sent from.  The address of a chunked message is
+// that of its first chunk.  If raw isn't nil, it is set to a copy of
+// the message's JSON.  How the message was received is recorded in
+// transport.
+func (r *Reader) readToMap(raw *[]byte, transport *Transport) (msg map[string]interface{}, from net.Addr, err error) {
+	bp := r.getBuf()
+	defer r.putBuf(bp)
+
+	payload, from, err := r.readPayload(*bp, transport)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg, err = r.decodePayload(payload, raw, transport); err != nil {
+		return nil, nil, err
+	}
+	return msg, from, nil
+}
+
+// readPayload reads the next message, reassembling it if it is
+// chunked, and returns its payload, which is in cBuf, a datagram
+// buffer, unless it was chunked.
+func (r *Reader) readPayload(cBuf []byte, transport *Transport) ([]byte, net.Addr, error) {
+	var (
+		n       int
+		from    net.Addr
+		err     error
+		touched []string // keys of the messages we got chunks of
+	)
+
+	*transport = Transport{}
+	if r.isClosed() {
+		return nil, nil, ErrReaderClosed
 	}
 
-	if val, ok := mapped["timestamp"]; ok && val != nil {
-		switch val.(type) {
-		case string:
-			v, err := strconv.ParseFloat(val.(string), 64)
-			if err == nil {
-				msg.TimeUnix = v
+	// Chunks of different messages may arrive interleaved, so keep
+	// reading until either an unchunked datagram arrives or some
+	// chunk completes the message it belongs to.
+	for {
+		if n, from, err = r.readFrom(cBuf); err != nil {
+			// don't leave half-assembled messages behind for
+			// the next read
+			for _, key := range touched {
+				r.discardChunkSet(key)
+			}
+			if r.isClosed() {
+				return nil, nil, ErrReaderClosed
 			}
-		case float64:
-			msg.TimeUnix = val.(float64)
+			return nil, nil, err
 		}
-	}
+		cBuf = cBuf[:n]
+		r.counters.received.Add(1)
+		r.counters.bytes.Add(uint64(n))
 
-	if val, ok := mapped["level"]; ok && val != nil {
-		switch val.(type) {
-		case float64:
-			msg.Level = int32(val.(float64))
-		case int32:
-			msg.Level = val.(int32)
+		if n > r.maxDatagramSize {
+			r.counters.dropped.Add(1)
+			return nil, nil, fmt.Errorf("%w: more than %d bytes from %s",
+				ErrDatagramTooLarge, r.maxDatagramSize, from)
+		}
+
+		// an empty datagram, like a keep-alive probe, holds no
+		// message at all
+		if n == 0 {
+			cBuf = cBuf[:cap(cBuf)]
+			continue
 		}
-	}
 
-	if val, ok := mapped["facility"]; ok && val != nil {
-		v := val.(string)
+		if !r.chunkParser.IsChunk(cBuf) {
+			break
+		}
+		r.counters.chunked.Add(1)
 
-		if len(v) > 0 {
-			msg.Facility = v
+		h, payload, err := r.chunkParser.ParseChunkHeader(cBuf)
+		if err == nil && (h.Seq < 0 || h.Seq >= h.Total) {
+			err = ErrInvalidChunkHeader
+		}
+		if err != nil {
+			r.counters.dropped.Add(1)
+			return nil, nil, err
 		}
+		if h.Total > r.maxChunks {
+			r.counters.dropped.Add(1)
+			return nil, nil, fmt.Errorf("%w: message %x has %d, at most %d allowed",
+				ErrTooManyChunks, h.ID, h.Total, r.maxChunks)
+		}
+
+		key := r.chunkKey(from, h.ID)
+		touched = append(touched, key)
+		assembled, first, err := r.addChunk(key, h, payload, from)
+		if err != nil {
+			r.counters.dropped.Add(1)
+			return nil, nil, err
+		}
+		if assembled != nil {
+			r.counters.reassembled.Add(1)
+			transport.Chunked = true
+			transport.ChunkCount = h.Total
+			cBuf, from = assembled, first
+			break
+		}
+		cBuf = cBuf[:cap(cBuf)]
 	}
 
-	if val, ok := mapped["file"]; ok && val != nil {
-		v := val.(string)
+	if !transport.Chunked {
+		transport.ChunkCount = 1
+	}
+	return cBuf, from, nil
+}
 
-		if len(v) > 0 {
-			msg.File = v
+// decodePayload decodes the payload of a message, recording its
+// compression in transport.
+func (r *Reader) decodePayload(cBuf []byte, raw *[]byte, transport *Transport) (msg map[string]interface{}, err error) {
+	if msg, transport.Compression, err = r.dec.decodeRaw(cBuf, raw); err != nil {
+		r.counters.decodeErrors.Add(1)
+		if r.errorHandler != nil {
+			r.errorHandler(r.failedPayload(cBuf), err)
+			return nil, errHandled
 		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// errHandled is returned by readToMap for a message handed to the
+// error handler.
+var errHandled = errors.New("decoding error handled")
+
+// failedPayload returns the message in cBuf, which failed to decode,
+// for the error handler: decompressed if that works, and in a buffer
+// of its own either way.
+func (r *Reader) failedPayload(cBuf []byte) []byte {
+	var raw []byte
+	r.dec.decodeRaw(cBuf, &raw)
+	if raw == nil {
+		raw = append([]byte(nil), cBuf...)
+	}
+	return raw
+}
+
+// chunkKey returns the key of the chunk set of message cid, received
+// from addr.
+func (r *Reader) chunkKey(addr net.Addr, cid []byte) string {
+	if r.reassemblyKey != nil {
+		return r.reassemblyKey(addr, cid)
 	}
+	return string(cid)
+}
+
+// addChunk stores payload, that of the chunk with header h received
+// from addr, in the chunk set with the given key.  If that completes its message,
+// the message's chunks are dropped and their concatenation is
+// returned, along with the address its first chunk came from.
+func (r *Reader) addChunk(key string, h ChunkHeader, payload []byte, addr net.Addr) ([]byte, net.Addr, error) {
+	now := time.Now()
+	r.evictChunkSets(now)
+
+	cid, seq, total := h.ID, h.Seq, h.Total
 
-	if val, ok := mapped["line"]; ok && val != nil {
-		switch val.(type) {
-		case float64:
-			msg.Line = int32(val.(float64))
-		case int32:
-			msg.Line = val.(int32)
+	set, ok := r.chunkSets[key]
+	if !ok {
+		for len(r.chunkSets) >= r.maxPending {
+			r.discardOldestChunkSet()
 		}
+		set = &chunkSet{key: key, total: total, first: now, addr: addr}
+		set.elem = r.chunkOrder.PushBack(set)
+		r.chunkSets[key] = set
+	} else if !sameAddr(set.addr, addr) {
+		return nil, nil, fmt.Errorf("%w: chunk of message %x from %s (first came from %s)",
+			ErrOutOfBandMessage, cid, addr, set.addr)
+	} else if total != set.total {
+		return nil, nil, fmt.Errorf("%w: chunk of message %x says %d in total, not %d",
+			ErrInconsistentChunks, cid, total, set.total)
 	}
 
-	// Move fields started with underscore into "Extra"
-	for k, v := range mapped {
-		if strings.HasPrefix(k, "_") && v != nil {
-			extra[k[1:len(k)]] = v
+	// UDP may deliver the same datagram twice
+	if set.has(seq) {
+		return nil, nil, nil
+	}
+
+	r.storeChunk(set, seq, payload)
+	set.seen[seq/64] |= 1 << (seq % 64)
+	set.length += len(payload)
+	set.got++
+
+	if set.got < set.total {
+		held := set.size()
+		r.pendingBytes += held - set.held
+		set.held = held
+		for r.pendingBytes > r.maxPendingBytes {
+			r.discardOldestChunkSet()
 		}
+		return nil, nil, nil
 	}
+	r.forgetChunkSet(set)
 
-	if len(extra) > 0 {
-		msg.Extra = extra
+	if set.buf != nil {
+		return set.buf[:(set.total-1)*set.chunkLen+set.lastLen], set.addr, nil
 	}
+	buf := concatChunks(set)
+	r.releaseChunks(set)
 
-	return msg, nil
+	return buf, set.addr, nil
 }
 
-func (r *Reader) readToMap() (msg map[string]interface{}, err error) {
-	cBuf := make([]byte, ChunkSize)
-	var (
-		n, length  int
-		cid, ocid  []byte
-		seq, total uint8
-		cHead      []byte
-		cReader    io.Reader
-		chunks     [][]byte
-	)
+// storeChunk copies payload, chunk seq of set, to where it belongs.
+func (r *Reader) storeChunk(set *chunkSet, seq int, payload []byte) {
+	if set.buf == nil {
+		if set.chunks == nil {
+			set.chunks = make([]*[]byte, set.total)
+		}
+		set.chunks[seq] = r.copyChunk(payload)
+		if got := set.got + 1; !set.scattered && got < set.total && 2*got >= set.total {
+			r.gatherChunks(set)
+		}
+		return
+	}
 
-	for got := 0; got < 128 && (total == 0 || got < int(total)); got++ {
-		if n, err = r.conn.Read(cBuf); err != nil {
-			return nil, err
+	isLast := seq == set.total-1
+	switch {
+	case isLast && len(payload) <= set.chunkLen:
+		copy(set.buf[seq*set.chunkLen:], payload)
+		set.lastLen = len(payload)
+	case !isLast && len(payload) == set.chunkLen:
+		copy(set.buf[seq*set.chunkLen:], payload)
+	default:
+		r.scatterChunks(set)
+		set.chunks[seq] = r.copyChunk(payload)
+	}
+}
+
+// gatherChunks moves the chunks of set to buf, if they all have the
+// size of the first one but the last, which may be shorter.
+func (r *Reader) gatherChunks(set *chunkSet) {
+	chunkLen := -1
+	for _, bp := range set.chunks[:set.total-1] {
+		if bp != nil {
+			chunkLen = len(*bp)
+			break
 		}
-		cHead, cBuf = cBuf[:2], cBuf[:n]
+	}
+	if chunkLen < 0 {
+		// only the last one came, which doesn't tell the size
+		return
+	}
 
-		if bytes.Equal(cHead, magicChunked) {
-			//fmt.Printf("chunked %v\n", cBuf[:14])
-			cid, seq, total = cBuf[2:2+8], cBuf[2+8], cBuf[2+8+1]
-			if ocid != nil && !bytes.Equal(cid, ocid) {
-				return nil, fmt.Errorf("out-of-band message %v (awaited %v)", cid, ocid)
-			} else if ocid == nil {
-				ocid = cid
-				chunks = make([][]byte, total)
-			}
-			n = len(cBuf) - chunkedHeaderLen
-			//fmt.Printf("setting chunks[%d]: %d\n", seq, n)
-			chunks[seq] = append(make([]byte, 0, n), cBuf[chunkedHeaderLen:]...)
-			length += n
-		} else { //not chunked
-			if total > 0 {
-				return nil, fmt.Errorf("out-of-band message (not chunked)")
+	for seq, bp := range set.chunks {
+		if bp == nil {
+			continue
+		}
+		if n := len(*bp); chunkLen == 0 || n > chunkLen || n < chunkLen && seq < set.total-1 {
+			set.scattered = true
+			return
+		}
+	}
+
+	set.chunkLen = chunkLen
+	set.buf = make([]byte, set.total*chunkLen)
+	for seq, bp := range set.chunks {
+		if bp != nil {
+			copy(set.buf[seq*chunkLen:], *bp)
+			if seq == set.total-1 {
+				set.lastLen = len(*bp)
 			}
-			break
 		}
 	}
-	//fmt.Printf("\nchunks: %v\n", chunks)
+	r.releaseChunks(set)
+	set.chunks = nil
+}
 
-	if length > 0 {
-		if cap(cBuf) < length {
-			cBuf = append(cBuf, make([]byte, 0, length-cap(cBuf))...)
+// scatterChunks makes set fall back to a buffer per chunk, copying out
+// those already received.
+func (r *Reader) scatterChunks(set *chunkSet) {
+	set.chunks = make([]*[]byte, set.total)
+	for seq := 0; seq < set.total; seq++ {
+		if !set.has(seq) {
+			continue
 		}
-		cBuf = cBuf[:0]
-		for i := range chunks {
-			//fmt.Printf("appending %d %v\n", i, chunks[i])
-			cBuf = append(cBuf, chunks[i]...)
+		n := set.chunkLen
+		if seq == set.total-1 {
+			n = set.lastLen
 		}
-		cHead = cBuf[:2]
+		set.chunks[seq] = r.copyChunk(set.buf[seq*set.chunkLen:][:n])
 	}
+	set.buf = nil
+	set.scattered = true
+}
 
-	// the data we get from the wire is compressed
-	if bytes.Equal(cHead, magicGzip) {
-		cReader, err = gzip.NewReader(bytes.NewReader(cBuf))
-	} else if cHead[0] == magicZlib[0] &&
-		(int(cHead[0])*256+int(cHead[1]))%31 == 0 {
-		// zlib is slightly more complicated, but correct
-		cReader, err = zlib.NewReader(bytes.NewReader(cBuf))
-	} else {
-		// compliance with https://github.com/Graylog2/graylog2-server
-		// treating all messages as uncompressed if  they are not gzip, zlib or
-		// chunked
-		cReader = bytes.NewReader(cBuf)
+// size returns the bytes of the buffers set holds.
+func (set *chunkSet) size() int {
+	n := len(set.buf)
+	for _, bp := range set.chunks {
+		if bp != nil {
+			n += cap(*bp)
+		}
 	}
+	return n
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("NewReader: %s", err)
+// copyChunk returns a copy of payload, in a buffer from the pool.
+func (r *Reader) copyChunk(payload []byte) *[]byte {
+	bp := r.getBuf()
+	*bp = append((*bp)[:0], payload...)
+	return bp
+}
+
+// concatChunks concatenates the chunks of set, which must all have
+// been received.
+func concatChunks(set *chunkSet) []byte {
+	buf := make([]byte, 0, set.length)
+	for _, bp := range set.chunks {
+		buf = append(buf, *bp...)
+	}
+	return buf
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
 
-	if err := json.NewDecoder(cReader).Decode(&msg); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %s", err)
+// evictChunkSets drops the messages that have been waiting for their
+// remaining chunks for longer than the reassembly timeout.
+func (r *Reader) evictChunkSets(now time.Time) {
+	if r.reassemblyTimeout <= 0 {
+		return
 	}
 
-	return msg, nil
+	for e := r.chunkOrder.Front(); e != nil; e = r.chunkOrder.Front() {
+		if now.Sub(e.Value.(*chunkSet).first) <= r.reassemblyTimeout {
+			break
+		}
+		r.discardOldestChunkSet()
+	}
+}
+
+// discardOldestChunkSet drops the message that has been waiting for
+// its remaining chunks the longest.
+func (r *Reader) discardOldestChunkSet() {
+	if e := r.chunkOrder.Front(); e != nil {
+		r.discardChunkSet(e.Value.(*chunkSet).key)
+	}
+}
+
+func (r *Reader) discardChunkSet(key string) {
+	if set, ok := r.chunkSets[key]; ok {
+		r.forgetChunkSet(set)
+		r.releaseChunks(set)
+		r.counters.incomplete.Add(1)
+		r.counters.dropped.Add(1)
+	}
+}
+
+// forgetChunkSet removes set from the messages being reassembled.
+func (r *Reader) forgetChunkSet(set *chunkSet) {
+	delete(r.chunkSets, set.key)
+	r.chunkOrder.Remove(set.elem)
+	set.elem = nil
+	r.pendingBytes -= set.held
+	set.held = 0
+}
+
+// discardChunkSets drops every message being reassembled.
+func (r *Reader) discardChunkSets() {
+	r.readMu.Lock()
+	defer r.readMu.Unlock()
+
+	for r.chunkOrder.Len() > 0 {
+		r.discardOldestChunkSet()
+	}
+}
+
+// releaseChunks hands the buffers of set back to the pool.  Nothing
+// may refer to them afterwards.
+func (r *Reader) releaseChunks(set *chunkSet) {
+	for i, bp := range set.chunks {
+		if bp != nil {
+			r.putBuf(bp)
+			set.chunks[i] = nil
+		}
+	}
+}
+
+// getBuf returns a datagram buffer from the reader's pool.
+func (r *Reader) getBuf() *[]byte {
+	return r.bufPool.Get().(*[]byte)
+}
+
+func (r *Reader) putBuf(bp *[]byte) {
+	*bp = (*bp)[:cap(*bp)]
+	r.bufPool.Put(bp)
 }
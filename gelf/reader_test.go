@@ -0,0 +1,1648 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendRaw writes each of the given datagrams, unmodified, to addr.
+func sendRaw(t *testing.T, addr string, datagrams ...[]byte) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	for i, d := range datagrams {
+		if _, err = conn.Write(d); err != nil {
+			t.Fatalf("Write (datagram %d): %s", i, err)
+		}
+	}
+}
+
+// chunk builds a chunked-GELF datagram carrying data as chunk seq of
+// total for the message whose id is eight repetitions of id.
+func chunk(id byte, seq, total uint8, data string) []byte {
+	b := append([]byte{}, magicChunked...)
+	for i := 0; i < 8; i++ {
+		b = append(b, id)
+	}
+	b = append(b, seq, total)
+
+	return append(b, data...)
+}
+
+// tests that Read hands out messages larger than the caller's buffer
+// across several calls, without losing any bytes
+func TestReadSmallBuffer(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+
+	sendRaw(t, r.Addr(),
+		[]byte(`{"version":"1.1","host":"h","short_message":"first message"}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"second"}`))
+
+	if n, err := r.Read(nil); n != 0 || err != nil {
+		t.Errorf("Read(nil): expected (0, nil), got (%d, %v)", n, err)
+	}
+
+	var got []byte
+	p := make([]byte, 4)
+	for len(got) < len("first messagesecond") {
+		n, err := r.Read(p)
+		if err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		got = append(got, p[:n]...)
+	}
+
+	if string(got) != "first messagesecond" {
+		t.Errorf("Read: expected %q, got %q", "first messagesecond", got)
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := r.ReadMessage()
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err = r.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if err = <-errc; err != ErrReaderClosed {
+		t.Errorf("blocked ReadMessage: expected ErrReaderClosed, got %v", err)
+	}
+
+	if _, err = r.ReadMessage(); err != ErrReaderClosed {
+		t.Errorf("ReadMessage after Close: expected ErrReaderClosed, got %v", err)
+	}
+	if addr := r.Addr(); addr != "" {
+		t.Errorf("Addr after Close: expected \"\", got %q", addr)
+	}
+	if addr := new(Reader).Addr(); addr != "" {
+		t.Errorf("Addr without a connection: expected \"\", got %q", addr)
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = r.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err = r.ReadMessageContext(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// the reader must still be usable afterwards
+	sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"after"}`))
+	msg, err := r.ReadMessageContext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadMessageContext: %s", err)
+	}
+	if msg.Short != "after" {
+		t.Errorf("msg.Short: expected after, got %s", msg.Short)
+	}
+}
+
+// tests that chunks of several messages may arrive interleaved
+// tests that cancelling a read in the middle of a chunked message
+// returns promptly and forgets the chunks received so far
+func TestReadMessageContextMidReassembly(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	a := `{"version":"1.1","host":"h","short_message":"half delivered"}`
+	sendRaw(t, r.Addr(), chunk('a', 0, 3, a[:20]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, err = r.ReadMessageContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadMessageContext took %s to notice the cancellation", elapsed)
+	}
+	if len(r.chunkSets) != 0 {
+		t.Errorf("expected no pending chunk sets, got %d", len(r.chunkSets))
+	}
+
+	// the rest of the message can't complete it anymore
+	sendRaw(t, r.Addr(), chunk('a', 1, 3, a[20:40]), chunk('a', 2, 3, a[40:]),
+		[]byte(`{"version":"1.1","host":"h","short_message":"after"}`))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "after" {
+		t.Errorf("msg.Short: expected after, got %s", msg.Short)
+	}
+}
+
+func TestReadInterleavedChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	a := `{"version":"1.1","host":"h","short_message":"message a"}`
+	b := `{"version":"1.1","host":"h","short_message":"message b"}`
+	sendRaw(t, r.Addr(),
+		chunk('a', 0, 2, a[:20]),
+		chunk('b', 1, 3, b[20:40]),
+		chunk('b', 0, 3, b[:20]),
+		chunk('a', 1, 2, a[20:]),
+		chunk('b', 2, 3, b[40:]))
+
+	for _, expected := range []string{"message a", "message b"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+}
+
+// tests that incomplete messages are forgotten after the reassembly
+// timeout
+func TestReadEvictsIncompleteChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	r.SetReassemblyTimeout(10 * time.Millisecond)
+
+	a := `{"version":"1.1","host":"h","short_message":"message a"}`
+	sendRaw(t, r.Addr(), chunk('x', 0, 2, "lost"), []byte(a))
+	if _, err = r.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if len(r.chunkSets) != 1 {
+		t.Fatalf("expected 1 pending chunk set, got %d", len(r.chunkSets))
+	}
+	time.Sleep(20 * time.Millisecond)
+	sendRaw(t, r.Addr(), chunk('a', 0, 2, a[:20]), chunk('a', 1, 2, a[20:]))
+
+	if _, err = r.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if len(r.chunkSets) != 0 {
+		t.Errorf("expected no pending chunk sets, got %d", len(r.chunkSets))
+	}
+	if n := r.DiscardedPartials(); n != 1 {
+		t.Errorf("DiscardedPartials: expected 1, got %d", n)
+	}
+}
+
+// tests that empty datagrams are skipped
+func TestReadEmptyDatagram(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	sendRaw(t, r.Addr(), []byte{}, []byte(`{"version":"1.1","host":"h","short_message":"after empty"}`))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "after empty" {
+		t.Errorf("msg.Short: expected after empty, got %s", msg.Short)
+	}
+	if n := r.Stats().Received; n != 2 {
+		t.Errorf("Stats().Received: expected 2, got %d", n)
+	}
+}
+
+// tests that a chunk delivered twice is only used once
+func TestReadDuplicateChunk(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	a := `{"version":"1.1","host":"h","short_message":"duplicated"}`
+	sendRaw(t, r.Addr(),
+		chunk('a', 0, 3, a[:20]),
+		chunk('a', 1, 3, a[20:40]),
+		chunk('a', 1, 3, a[20:40]),
+		chunk('a', 2, 3, a[40:]))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "duplicated" {
+		t.Errorf("msg.Short: expected duplicated, got %s", msg.Short)
+	}
+}
+
+// tests that a message missing a chunk is never delivered, nor holds
+// up the next one
+func TestReadMissingChunk(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(`{"version":"1.1","host":"h","short_message":"gap"}`))
+	zw.Close()
+	z := zBuf.String()
+	third := len(z) / 3
+
+	a := `{"version":"1.1","host":"h","short_message":"message a"}`
+	sendRaw(t, r.Addr(),
+		chunk('z', 0, 3, z[:third]),
+		chunk('z', 2, 3, z[2*third:]),
+		[]byte(a))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "message a" {
+		t.Errorf("msg.Short: expected message a, got %s", msg.Short)
+	}
+}
+
+func TestReadInvalidChunkHeader(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	sendRaw(t, r.Addr(),
+		[]byte{0x1e, 0x0f, 0x00},
+		chunk('a', 3, 3, "seq out of range"),
+		[]byte(`{"version":"1.1","host":"h","short_message":"still alive"}`))
+
+	for i := 0; i < 2; i++ {
+		if _, err = r.ReadMessage(); err != ErrInvalidChunkHeader {
+			t.Errorf("expected ErrInvalidChunkHeader, got %v", err)
+		}
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "still alive" {
+		t.Errorf("msg.Short: expected still alive, got %s", msg.Short)
+	}
+}
+
+func TestReadInconsistentChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	// the chunks claiming 5 or 3 in total, and the one numbered 2 of
+	// 2, would index past the 2 slots of the message
+	sendRaw(t, r.Addr(),
+		chunk(1, 0, 2, `{"version":"1.1","host":"h",`),
+		chunk(1, 4, 5, "too far"),
+		chunk(1, 1, 3, "too many"),
+		chunk(1, 2, 2, "seq == total"),
+		chunk(1, 1, 2, `"short_message":"consistent"}`))
+
+	for _, expected := range []error{ErrInconsistentChunks, ErrInconsistentChunks, ErrInvalidChunkHeader} {
+		if _, err = r.ReadMessage(); !errors.Is(err, expected) {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "consistent" {
+		t.Errorf("msg.Short: expected consistent, got %s", msg.Short)
+	}
+}
+
+func TestWithMaxDatagramSize(t *testing.T) {
+	big := `{"version":"1.1","host":"h","short_message":"` + strings.Repeat("x", 2000) + `"}`
+	after := `{"version":"1.1","host":"h","short_message":"after"}`
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	sendRaw(t, r.Addr(), []byte(big), []byte(after))
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("expected ErrDatagramTooLarge, got %v", err)
+	}
+	if msg, err := r.ReadMessage(); err != nil || msg.Short != "after" {
+		t.Errorf("expected the next message, got %v, %v", msg, err)
+	}
+
+	r, err = NewReader("127.0.0.1:0", WithMaxDatagramSize(4096))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	sendRaw(t, r.Addr(), []byte(big))
+	if msg, err := r.ReadMessage(); err != nil || len(msg.Short) != 2000 {
+		t.Errorf("expected the large message, got %v, %v", msg, err)
+	}
+
+	for _, n := range []int{0, chunkedHeaderLen, 65508} {
+		if _, err = NewReader("127.0.0.1:0", WithMaxDatagramSize(n)); err == nil {
+			t.Errorf("WithMaxDatagramSize(%d) didn't fail", n)
+		}
+	}
+}
+
+func TestWithMaxChunks(t *testing.T) {
+	if _, err := NewReader("127.0.0.1:0", WithMaxChunks(0)); err == nil {
+		t.Errorf("expected an error for 0 max chunks")
+	}
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	sendRaw(t, r.Addr(), chunk(1, 0, 200, "{"))
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrTooManyChunks) {
+		t.Errorf("total=200: expected ErrTooManyChunks, got %v", err)
+	}
+
+	r2, err := NewReader("127.0.0.1:0", WithMaxChunks(2))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r2.Close()
+
+	sendRaw(t, r2.Addr(),
+		chunk(1, 0, 3, `{"version":"1.1",`),
+		chunk(2, 0, 2, `{"version":"1.1","host":"h",`),
+		chunk(2, 1, 2, `"short_message":"two chunks"}`))
+	if _, err = r2.ReadMessage(); !errors.Is(err, ErrTooManyChunks) {
+		t.Errorf("total=3: expected ErrTooManyChunks, got %v", err)
+	}
+	msg, err := r2.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "two chunks" {
+		t.Errorf("msg.Short: expected two chunks, got %s", msg.Short)
+	}
+}
+
+// forgedChunkConn hands out n first chunks of distinct 128 chunk
+// messages, of the largest size, then a message of its own.
+type forgedChunkConn struct {
+	replayConn
+	n    int
+	sent int
+}
+
+func (c *forgedChunkConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.sent == c.n {
+		return copy(b, `{"version":"1.1","host":"h","short_message":"last"}`), nil, nil
+	}
+	c.sent++
+	d := append([]byte{}, magicChunked...)
+	d = binary.BigEndian.AppendUint64(d, uint64(c.sent))
+	d = append(d, 0, 128)
+	d = append(d, bytes.Repeat([]byte("x"), ChunkSize-len(d))...)
+	return copy(b, d), nil, nil
+}
+
+// tests that first chunks of messages that never complete can't make
+// the reader hold more than its limits
+func TestReadForgedFirstChunks(t *testing.T) {
+	for _, tt := range []struct {
+		opts     []ReaderOption
+		sets     int
+		maxBytes int
+	}{
+		{nil, defaultMaxPendingMessages, defaultMaxPendingBytes},
+		{[]ReaderOption{WithMaxPendingMessages(10)}, 10, defaultMaxPendingBytes},
+		{[]ReaderOption{WithMaxPendingBytes(64 << 10)}, 64 << 10 / (ChunkSize + 1), 64 << 10},
+	} {
+		const n = 3000
+		r, err := newReader(&forgedChunkConn{n: n}, tt.opts)
+		if err != nil {
+			t.Fatalf("newReader: %s", err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != "last" {
+			t.Errorf("msg.Short: expected last, got %s", msg.Short)
+		}
+
+		if len(r.chunkSets) != tt.sets || r.chunkOrder.Len() != tt.sets {
+			t.Errorf("expected %d pending chunk sets, got %d", tt.sets, len(r.chunkSets))
+		}
+		// a buffer for each chunk, none for the whole message
+		if r.pendingBytes != tt.sets*(ChunkSize+1) || r.pendingBytes > tt.maxBytes {
+			t.Errorf("expected %d bytes pending, got %d", tt.sets*(ChunkSize+1), r.pendingBytes)
+		}
+		if incomplete := r.Stats().Incomplete; incomplete != uint64(n-tt.sets) {
+			t.Errorf("Incomplete: expected %d, got %d", n-tt.sets, incomplete)
+		}
+		// the most recent messages are kept
+		if _, ok := r.chunkSets[string(binary.BigEndian.AppendUint64(nil, n))]; !ok {
+			t.Errorf("the last message was dropped")
+		}
+	}
+
+	if _, err := NewReader("127.0.0.1:0", WithMaxPendingMessages(0)); err == nil {
+		t.Errorf("expected an error for 0 max pending messages")
+	}
+	if _, err := NewReader("127.0.0.1:0", WithMaxPendingBytes(0)); err == nil {
+		t.Errorf("expected an error for 0 max pending bytes")
+	}
+}
+
+func TestWithReadBufferSize(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithReadBufferSize(1<<16))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	r.Close()
+
+	if _, err = NewReader("127.0.0.1:0", WithReadBufferSize(-1)); err == nil {
+		t.Errorf("expected an error for a negative buffer size")
+	}
+}
+
+func TestWithReusePort(t *testing.T) {
+	if !reusePortSupported {
+		if _, err := NewReader("127.0.0.1:0", WithReusePort()); err == nil {
+			t.Errorf("WithReusePort succeeded without SO_REUSEPORT")
+		}
+		return
+	}
+
+	r1, err := NewReader("127.0.0.1:0", WithReusePort())
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r1.Close()
+
+	r2, err := NewReader(r1.Addr(), WithReusePort())
+	if err != nil {
+		t.Fatalf("NewReader on the same port: %s", err)
+	}
+	defer r2.Close()
+
+	if r, err := NewReader(r1.Addr()); err == nil {
+		r.Close()
+		t.Errorf("NewReader without WithReusePort bound a shared port")
+	}
+
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	if _, err = NewUnixgramReader(path, WithReusePort()); err == nil {
+		t.Errorf("WithReusePort succeeded on a unixgram reader")
+	}
+}
+
+func TestReadMessageFrom(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	c1, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c2.Close()
+
+	a := `{"version":"1.1","host":"h","short_message":"from c1"}`
+	c1.Write(chunk('a', 0, 2, a[:20]))
+	c1.Write(chunk('a', 1, 2, a[20:]))
+
+	msg, from, err := r.ReadMessageFrom()
+	if err != nil {
+		t.Fatalf("ReadMessageFrom: %s", err)
+	}
+	if msg.Short != "from c1" {
+		t.Errorf("msg.Short: expected from c1, got %s", msg.Short)
+	}
+	if from.String() != c1.LocalAddr().String() {
+		t.Errorf("from: expected %s, got %s", c1.LocalAddr(), from)
+	}
+
+	// chunks of one message sent from different addresses
+	c1.Write(chunk('b', 0, 2, a[:20]))
+	c2.Write(chunk('b', 1, 2, a[20:]))
+	if _, _, err = r.ReadMessageFrom(); !errors.Is(err, ErrOutOfBandMessage) {
+		t.Errorf("expected ErrOutOfBandMessage for chunks from different senders, got %v", err)
+	}
+}
+
+func TestWithReassemblyKey(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithReassemblyKey(func(addr net.Addr, chunkID []byte) string {
+		return addr.String() + "/" + string(chunkID)
+	}))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	c1, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c2.Close()
+
+	// both senders use the same message id
+	a := `{"version":"1.1","host":"h","short_message":"from c1"}`
+	b := `{"version":"1.1","host":"h","short_message":"from c2"}`
+	c1.Write(chunk('x', 0, 2, a[:20]))
+	c2.Write(chunk('x', 0, 2, b[:20]))
+	c2.Write(chunk('x', 1, 2, b[20:]))
+	c1.Write(chunk('x', 1, 2, a[20:]))
+
+	for _, expected := range []string{"from c2", "from c1"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+}
+
+// tests that a highly compressed message can't inflate past the limit
+func TestReadMaxDecompressedSize(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	r.SetMaxDecompressedSize(1 << 20)
+
+	// gzip streams may be concatenated, so compress 1 MiB once and
+	// repeat it to get 100 MiB of JSON
+	gz := func(b []byte) []byte {
+		var zBuf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&zBuf, gzip.BestCompression)
+		zw.Write(b)
+		zw.Close()
+		return zBuf.Bytes()
+	}
+	zBytes := gz([]byte(`{"version":"1.1","host":"h","short_message":"`))
+	block := gz(bytes.Repeat([]byte{'a'}, 1<<20))
+	for i := 0; i < 100; i++ {
+		zBytes = append(zBytes, block...)
+	}
+	zBytes = append(zBytes, gz([]byte(`"}`))...)
+
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	if err = w.writeChunked(zBytes); err != nil {
+		t.Fatalf("writeChunked: %s", err)
+	}
+
+	if _, err = r.ReadMessage(); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+// tests that integers in extra fields keep their precision
+func TestReadLargeIntegerExtra(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"s",`+
+		`"timestamp":1385053862.3072,"level":3,"line":42,"_user_id":9007199254740993}`))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+
+	if msg.Extra["user_id"] != json.Number("9007199254740993") {
+		t.Errorf("_user_id: expected 9007199254740993, got %v", msg.Extra["user_id"])
+	}
+	if msg.TimeUnix != 1385053862.3072 || msg.Level != 3 || msg.Line != 42 {
+		t.Errorf("expected timestamp 1385053862.3072, level 3 and line 42, got %v, %d and %d",
+			msg.TimeUnix, msg.Level, msg.Line)
+	}
+}
+
+func TestReadFlattenExtras(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	r.SetFlattenExtras(true)
+
+	sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"s",`+
+		`"_a":{"b":"x","c":{"d":"y"}},"_tags":["t0",{"k":"t1"}],"_a.b":"kept","_empty":{}}`))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"a.b":      "kept",
+		"a.c.d":    "y",
+		"tags.0":   "t0",
+		"tags.1.k": "t1",
+	}
+	if len(msg.Extra) != len(expected) {
+		t.Errorf("msg.Extra: expected %v, got %v", expected, msg.Extra)
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("msg.Extra[%q]: expected %v, got %v", k, v, msg.Extra[k])
+		}
+	}
+}
+
+func TestReadKeepExtraPrefix(t *testing.T) {
+	data := []byte(`{"version":"1.1","host":"h","short_message":"s","_user_id":"u1","_n":2,"id":"top"}`)
+	r, err := newReader(&replayConn{datagram: data}, nil)
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+	r.SetKeepExtraPrefix(true)
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if len(msg.Extra) != 2 || msg.Extra["_user_id"] != "u1" || msg.Extra["_n"] == nil {
+		t.Errorf("msg.Extra: expected _user_id and _n, got %v", msg.Extra)
+	}
+	if msg.Unknown["id"] != "top" {
+		t.Errorf("msg.Unknown: expected id, got %v", msg.Unknown)
+	}
+
+	// sent again, the fields are the same
+	b, err := msg.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+	if !bytes.Contains(b, []byte(`"_user_id":"u1"`)) || bytes.Contains(b, []byte("__")) {
+		t.Errorf("MarshalJSON: unexpected fields in %s", b)
+	}
+}
+
+func TestReadStrict(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	r.SetStrict(true)
+
+	sendRaw(t, r.Addr(),
+		[]byte(`{"short_message":"no version or host"}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"valid"}`))
+
+	if msg, err := r.ReadMessage(); err == nil {
+		t.Errorf("expected an error, got %+v", msg)
+	}
+	if _, err = r.ReadMessage(); err != nil {
+		t.Errorf("ReadMessage: %s", err)
+	}
+}
+
+func TestReadReservedFields(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	if err = r.SetReservedFields(ReservedFieldPolicy(42)); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+
+	for policy, expected := range map[ReservedFieldPolicy]string{
+		ReservedDrop:   "",
+		ReservedRename: "orig_id",
+		ReservedKeep:   "id",
+	} {
+		if err = r.SetReservedFields(policy); err != nil {
+			t.Fatalf("SetReservedFields: %s", err)
+		}
+		sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"s","_id":"x","_a":1}`))
+
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		_, hasID := msg.Extra["id"]
+		if expected == "" && (hasID || len(msg.Extra) != 1) {
+			t.Errorf("policy %d: expected only the a field, got %v", policy, msg.Extra)
+		}
+		if expected != "" && msg.Extra[expected] != "x" {
+			t.Errorf("policy %d: expected %s=x, got %v", policy, expected, msg.Extra)
+		}
+	}
+}
+
+func TestNewReaderFamilies(t *testing.T) {
+	r, err := NewReader4(":0")
+	if err != nil {
+		t.Fatalf("NewReader4: %s", err)
+	}
+	defer r.Close()
+	if !strings.HasPrefix(r.Addr(), "0.0.0.0:") {
+		t.Errorf("NewReader4: expected an IPv4 wildcard address, got %s", r.Addr())
+	}
+	if _, err = NewReader4("[::1]:0"); err == nil {
+		t.Errorf("NewReader4: expected an error for an IPv6 address")
+	}
+
+	r6, err := NewReader6("[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %s", err)
+	}
+	defer r6.Close()
+	if !strings.HasPrefix(r6.Addr(), "[::1]:") {
+		t.Errorf("NewReader6: expected an IPv6 address, got %s", r6.Addr())
+	}
+
+	sendRaw(t, r6.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"v6"}`))
+	msg, err := r6.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "v6" {
+		t.Errorf("msg.Short: expected v6, got %s", msg.Short)
+	}
+}
+
+func TestReadMessageRaw(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	doc := `{"version":"1.1","host":"h","short_message":"raw","vendor":{"x":1}}`
+	half := len(doc) / 2
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(doc))
+	zw.Close()
+
+	for i, datagrams := range [][][]byte{
+		{zBuf.Bytes()},
+		{chunk(1, 0, 2, doc[:half]), chunk(1, 1, 2, doc[half:])},
+	} {
+		sendRaw(t, r.Addr(), datagrams...)
+		msg, raw, err := r.ReadMessageRaw()
+		if err != nil {
+			t.Fatalf("ReadMessageRaw: %s", err)
+		}
+		if msg.Short != "raw" {
+			t.Errorf("msg.Short: expected raw, got %s", msg.Short)
+		}
+		if string(raw) != doc {
+			t.Errorf("expected raw JSON %s, got %s", doc, raw)
+		}
+
+		// the pooled buffers are reused, but raw must not change
+		saved := string(raw)
+		sendRaw(t, r.Addr(), chunk(byte(2+i), 0, 2, strings.Repeat("x", 100)),
+			[]byte(`{"version":"1.1","host":"h","short_message":"overwrite"}`))
+		if _, err = r.ReadMessage(); err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if string(raw) != saved {
+			t.Errorf("raw JSON changed to %s", raw)
+		}
+	}
+}
+
+func TestReadMessageInto(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	sendRaw(t, r.Addr(),
+		[]byte(`{"version":"1.1","host":"h","short_message":"first","full_message":"f","_a":1,"x":true}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"second","_b":2}`))
+
+	var msg Message
+	if err = r.ReadMessageInto(&msg); err != nil {
+		t.Fatalf("ReadMessageInto: %s", err)
+	}
+	if msg.Short != "first" || fmt.Sprint(msg.Extra["a"]) != "1" || msg.Unknown["x"] != true {
+		t.Errorf("unexpected first message %+v", msg)
+	}
+
+	if err = r.ReadMessageInto(&msg); err != nil {
+		t.Fatalf("ReadMessageInto: %s", err)
+	}
+	if msg.Short != "second" || msg.Full != "" || len(msg.Extra) != 1 || fmt.Sprint(msg.Extra["b"]) != "2" || len(msg.Unknown) != 0 {
+		t.Errorf("unexpected second message %+v", msg)
+	}
+}
+
+func TestReadMinLevel(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	r.SetMinLevel(LevelWarning)
+
+	sendRaw(t, r.Addr(),
+		[]byte(`{"version":"1.1","host":"h","short_message":"debug","level":7}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"notice","level":5}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"warning","level":4}`),
+		[]byte(`{"version":"1.1","host":"h","short_message":"error","level":3}`))
+
+	for _, expected := range []string{"warning", "error"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+
+	r.SetMinLevel(-1)
+	sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"debug","level":7}`))
+	if msg, err := r.ReadMessage(); err != nil || msg.Short != "debug" {
+		t.Errorf("without filter: expected debug, got %v, %v", msg, err)
+	}
+}
+
+// tests that goroutines reading at once from one reader each get
+// whole, uncorrupted messages
+func TestReadConcurrent(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithReadBufferSize(4<<20))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	const count = 200
+	msgs := make(chan *Message, count)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				msg, err := r.ReadMessage()
+				if err == ErrReaderClosed {
+					return
+				}
+				if err != nil {
+					t.Errorf("ReadMessage: %s", err)
+					continue
+				}
+				msgs <- msg
+			}
+		}()
+	}
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	for i := 0; i < count; i++ {
+		doc := fmt.Sprintf(`{"version":"1.1","host":"h","short_message":"%d","full_message":"%s"}`,
+			i, strings.Repeat(strconv.Itoa(i%10), 60))
+		third := len(doc) / 3
+		for seq, part := range []string{doc[:third], doc[third : 2*third], doc[2*third:]} {
+			if _, err = conn.Write(chunk(byte(i), uint8(seq), 3, part)); err != nil {
+				t.Fatalf("Write: %s", err)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < count {
+		select {
+		case msg := <-msgs:
+			n, err := strconv.Atoi(msg.Short)
+			if err != nil || msg.Full != strings.Repeat(strconv.Itoa(n%10), 60) {
+				t.Fatalf("corrupted message %q: %q", msg.Short, msg.Full)
+			}
+			if seen[msg.Short] {
+				t.Errorf("message %s read twice", msg.Short)
+			}
+			seen[msg.Short] = true
+		case <-timeout:
+			t.Fatalf("got %d of %d messages", len(seen), count)
+		}
+	}
+}
+
+func TestReadTransport(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0", WithDecompressor(NewZstdDecompressor(unzstdRaw)))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	doc := `{"version":"1.1","host":"h","short_message":"transport"}`
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(doc))
+	zw.Close()
+	gzipped := zBuf.String()
+
+	for _, tc := range []struct {
+		datagrams [][]byte
+		expected  Transport
+	}{
+		{[][]byte{[]byte(doc)}, Transport{false, 1, "none"}},
+		{[][]byte{zBuf.Bytes()}, Transport{false, 1, "gzip"}},
+		{[][]byte{zstdRaw([]byte(doc))}, Transport{false, 1, "zstd"}},
+		{[][]byte{chunk(1, 0, 3, gzipped[:10]), chunk(1, 1, 3, gzipped[10:20]), chunk(1, 2, 3, gzipped[20:])},
+			Transport{true, 3, "gzip"}},
+	} {
+		sendRaw(t, r.Addr(), tc.datagrams...)
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Transport != tc.expected {
+			t.Errorf("expected %+v, got %+v", tc.expected, msg.Transport)
+		}
+	}
+}
+
+func TestUnixgramReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	r, err := NewUnixgramReader(path)
+	if err != nil {
+		t.Fatalf("NewUnixgramReader: %s", err)
+	}
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	a := `{"version":"1.1","host":"h","short_message":"over unixgram"}`
+	conn.Write(chunk('a', 0, 2, a[:20]))
+	conn.Write(chunk('a', 1, 2, a[20:]))
+	conn.Close()
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "over unixgram" {
+		t.Errorf("msg.Short: expected over unixgram, got %s", msg.Short)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", path, err)
+	}
+}
+
+func TestNewReaderFromConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	// hide that pc is a net.Conn as well
+	r, err := NewReaderFromConn(struct{ net.PacketConn }{pc})
+	if err != nil {
+		t.Fatalf("NewReaderFromConn: %s", err)
+	}
+	defer r.Close()
+
+	sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"inherited"}`))
+	msg, from, err := r.ReadMessageFrom()
+	if err != nil {
+		t.Fatalf("ReadMessageFrom: %s", err)
+	}
+	if msg.Short != "inherited" || from == nil {
+		t.Errorf("expected the message and its sender, got %v, %v", msg, from)
+	}
+}
+
+func TestNewReaderFromNetConn(t *testing.T) {
+	client, server := net.Pipe()
+	r, err := NewReaderFromNetConn(server)
+	if err != nil {
+		t.Fatalf("NewReaderFromNetConn: %s", err)
+	}
+	defer r.Close()
+
+	a := `{"version":"1.1","host":"h","short_message":"over a pipe"}`
+	go func() {
+		client.Write(chunk('p', 0, 2, a[:20]))
+		client.Write(chunk('p', 1, 2, a[20:]))
+	}()
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "over a pipe" {
+		t.Errorf("msg.Short: expected over a pipe, got %s", msg.Short)
+	}
+
+	r.Close()
+	if _, err = client.Write([]byte("{}")); err == nil {
+		t.Errorf("Close didn't close the connection")
+	}
+}
+
+func TestReaderUDPConn(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	c, ok := r.UDPConn()
+	if !ok || c.LocalAddr().String() != r.Addr() {
+		t.Fatalf("UDPConn: expected the reader's socket, got %v, %t", c, ok)
+	}
+	if err = c.SetReadBuffer(1 << 16); err != nil {
+		t.Errorf("SetReadBuffer: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	u, err := NewUnixgramReader(path)
+	if err != nil {
+		t.Fatalf("NewUnixgramReader: %s", err)
+	}
+	defer u.Close()
+	if _, ok = u.UDPConn(); ok {
+		t.Errorf("UDPConn: expected false for a unixgram reader")
+	}
+}
+
+// replayConn is a net.PacketConn that hands out the same datagram on
+// every read.  Only ReadFrom and WriteTo may be used.
+type replayConn struct {
+	net.Conn
+	datagram []byte
+}
+
+func (c *replayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return copy(b, c.datagram), nil, nil
+}
+
+func (c *replayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkReadSmallUncompressed(b *testing.B) {
+	r, err := newReader(&replayConn{datagram: []byte(
+		`{"version":"1.1","host":"h","short_message":"short message","_file":"1234"}`)}, nil)
+	if err != nil {
+		b.Fatalf("newReader: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = r.ReadMessage(); err != nil {
+			b.Fatalf("ReadMessage: %s", err)
+		}
+	}
+}
+
+func BenchmarkReadMessageInto(b *testing.B) {
+	r, err := newReader(&replayConn{datagram: []byte(
+		`{"version":"1.1","host":"h","short_message":"short message","_file":"1234"}`)}, nil)
+	if err != nil {
+		b.Fatalf("newReader: %s", err)
+	}
+
+	var msg Message
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = r.ReadMessageInto(&msg); err != nil {
+			b.Fatalf("ReadMessageInto: %s", err)
+		}
+	}
+}
+
+func BenchmarkReadChunked(b *testing.B) {
+	payload := `{"version":"1.1","host":"h","short_message":"short message","_file":"1234"}`
+	conn := &chunkedReplayConn{chunks: [][]byte{
+		chunk('a', 0, 2, payload[:30]),
+		chunk('a', 1, 2, payload[30:]),
+	}}
+	r, err := newReader(conn, nil)
+	if err != nil {
+		b.Fatalf("newReader: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = r.ReadMessage(); err != nil {
+			b.Fatalf("ReadMessage: %s", err)
+		}
+	}
+}
+
+func BenchmarkReadChunked128(b *testing.B) {
+	// 128 chunks of the default size, the last one partly filled
+	dataLen := ChunkSize - chunkedHeaderLen
+	head := `{"version":"1.1","host":"h","short_message":"s","full_message":"`
+	payload := head + strings.Repeat("x", 127*dataLen+100-len(head)-2) + `"}`
+
+	conn := new(chunkedReplayConn)
+	for seq := 0; seq < 128; seq++ {
+		end := (seq + 1) * dataLen
+		if end > len(payload) {
+			end = len(payload)
+		}
+		conn.chunks = append(conn.chunks, chunk('a', uint8(seq), 128, payload[seq*dataLen:end]))
+	}
+	r, err := newReader(conn, nil)
+	if err != nil {
+		b.Fatalf("newReader: %s", err)
+	}
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = r.ReadMessage(); err != nil {
+			b.Fatalf("ReadMessage: %s", err)
+		}
+	}
+}
+
+// chunkedReplayConn hands out its chunks in turn, over and over.
+type chunkedReplayConn struct {
+	replayConn
+	chunks [][]byte
+	next   int
+}
+
+func (c *chunkedReplayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n := copy(b, c.chunks[c.next])
+	c.next = (c.next + 1) % len(c.chunks)
+	return n, nil, nil
+}
+
+func TestReadDecoderFunc(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	calls := 0
+	r.SetDecoderFunc(func(rd io.Reader) *json.Decoder {
+		calls++
+		return json.NewDecoder(rd)
+	})
+
+	sendRaw(t, r.Addr(), []byte(`{"version":"1.1","host":"h","short_message":"s","_n":1}`))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the decoder func to be called once, not %d times", calls)
+	}
+	if msg.Extra["n"] != float64(1) {
+		t.Errorf("msg.Extra: expected n=1 as a float64, got %#v", msg.Extra["n"])
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	a := `{"version":"1.1","host":"h","short_message":"message a"}`
+	sendRaw(t, r.Addr(),
+		[]byte(a),
+		chunk('a', 0, 2, a[:20]),
+		chunk('a', 1, 2, a[20:]),
+		[]byte("not json"),
+		chunk('b', 5, 2, "bad header"))
+
+	for i := 0; i < 4; i++ {
+		r.ReadMessage()
+	}
+
+	size := 2*len(a) + 3*chunkedHeaderLen + len("not json") + len("bad header")
+	expected := ReaderStats{Received: 5, Bytes: uint64(size), Chunked: 3, Reassembled: 1, Dropped: 1, DecodeErrors: 1}
+	if s := r.Stats(); s != expected {
+		t.Errorf("Stats: expected %+v, got %+v", expected, s)
+	}
+}
+
+func TestSetSpecVersion(t *testing.T) {
+	r, err := newReader(&replayConn{}, nil)
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+	conn := r.conn.(*replayConn)
+
+	if err = r.SetSpecVersion("2.0"); err == nil {
+		t.Errorf("SetSpecVersion accepted 2.0")
+	}
+
+	tests := []struct {
+		spec, datagram string
+		facility       interface{} // expected Extra["facility"]
+	}{
+		{"1.0", `{"version":"1.1","host":"h","short_message":"s","facility":"f"}`, nil},
+		{"1.1", `{"version":"1.0","host":"h","short_message":"s","facility":"f"}`, "f"},
+		{"1.1", `{"version":"1.1","host":"h","short_message":"s","facility":"f","_facility":"x"}`, "x"},
+		{"1.1", `{"version":"1.1","host":"h","short_message":"s"}`, nil},
+		{"auto", `{"version":"1.1","host":"h","short_message":"s","facility":"f"}`, "f"},
+		{"auto", `{"version":"1.0","host":"h","short_message":"s","facility":"f"}`, nil},
+	}
+	for _, tt := range tests {
+		if err = r.SetSpecVersion(tt.spec); err != nil {
+			t.Fatalf("SetSpecVersion(%s): %s", tt.spec, err)
+		}
+		conn.datagram = []byte(tt.datagram)
+
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if got := msg.Extra["facility"]; got != tt.facility {
+			t.Errorf("%s, %s: Extra[facility]: expected %v, got %v", tt.spec, tt.datagram, tt.facility, got)
+		}
+		if strings.Contains(tt.datagram, `"facility":"f"`) && msg.Facility != "f" {
+			t.Errorf("%s, %s: Facility: expected f, got %s", tt.spec, tt.datagram, msg.Facility)
+		}
+	}
+}
+
+// tests that reassembling an uncompressed chunked message yields the
+// exact payload, with no stale bytes from buffers that held longer
+// chunks of earlier messages
+func TestReadChunkedUncompressed(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = CompressNone
+	w.SetChunkSize(100)
+
+	for _, n := range []int{1000, 350, 90} {
+		m := &Message{Version: "1.1", Host: "h", Short: fmt.Sprint(n), Full: strings.Repeat("x", n)}
+		expected, err := m.MarshalJSON()
+		if err != nil {
+			t.Fatalf("MarshalJSON: %s", err)
+		}
+		if err = w.WriteMessage(m); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+
+		msg, raw, err := r.ReadMessageRaw()
+		if err != nil {
+			t.Fatalf("ReadMessageRaw: %s", err)
+		}
+		if !bytes.Equal(raw, expected) {
+			t.Errorf("%d: expected payload\n%s\ngot\n%s", n, expected, raw)
+		}
+		if msg.Full != m.Full || msg.Transport.Compression != "none" {
+			t.Errorf("%d: unexpected message %+v", n, msg)
+		}
+		if !msg.Transport.Chunked || msg.Transport.ChunkCount < 2 {
+			t.Errorf("%d: expected several chunks, got %+v", n, msg.Transport)
+		}
+	}
+
+	// out of order, the short last chunk first
+	payload := `{"version":"1.1","host":"h","short_message":"reordered"}`
+	rr, err := newReader(&chunkedReplayConn{chunks: [][]byte{
+		chunk('b', 2, 3, payload[40:]),
+		chunk('b', 0, 3, payload[:20]),
+		chunk('b', 1, 3, payload[20:40]),
+	}}, nil)
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+	_, raw, err := rr.ReadMessageRaw()
+	if err != nil {
+		t.Fatalf("ReadMessageRaw: %s", err)
+	}
+	if string(raw) != payload {
+		t.Errorf("expected payload %s, got %s", payload, raw)
+	}
+}
+
+// tests reassembly of chunks of varying sizes, which don't fit the
+// layout of a single buffer
+func TestReadChunkedVariableSizes(t *testing.T) {
+	payload := `{"version":"1.1","host":"h","short_message":"variable sizes"}`
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"single", [][]byte{chunk('a', 0, 1, payload)}},
+		{"short last first", [][]byte{
+			chunk('a', 2, 3, payload[50:]),
+			chunk('a', 0, 3, payload[:25]),
+			chunk('a', 1, 3, payload[25:50]),
+		}},
+		{"long last first", [][]byte{
+			chunk('a', 2, 3, payload[20:]),
+			chunk('a', 0, 3, payload[:10]),
+			chunk('a', 1, 3, payload[10:20]),
+		}},
+		{"long last", [][]byte{
+			chunk('a', 0, 3, payload[:10]),
+			chunk('a', 1, 3, payload[10:20]),
+			chunk('a', 2, 3, payload[20:]),
+		}},
+		{"uneven", [][]byte{
+			chunk('a', 0, 4, payload[:20]),
+			chunk('a', 3, 4, payload[50:]),
+			chunk('a', 1, 4, payload[20:30]),
+			chunk('a', 2, 4, payload[30:50]),
+		}},
+		{"empty first", [][]byte{
+			chunk('a', 0, 3, ""),
+			chunk('a', 1, 3, payload[:30]),
+			chunk('a', 2, 3, payload[30:]),
+		}},
+		{"empty middle", [][]byte{
+			chunk('a', 0, 3, payload[:30]),
+			chunk('a', 1, 3, ""),
+			chunk('a', 2, 3, payload[30:]),
+		}},
+	}
+	for _, tt := range tests {
+		r, err := newReader(&chunkedReplayConn{chunks: tt.chunks}, nil)
+		if err != nil {
+			t.Fatalf("newReader: %s", err)
+		}
+		// twice, to reuse the pooled buffers
+		for i := 0; i < 2; i++ {
+			_, raw, err := r.ReadMessageRaw()
+			if err != nil {
+				t.Errorf("%s: ReadMessageRaw: %s", tt.name, err)
+				break
+			}
+			if string(raw) != payload {
+				t.Errorf("%s: expected payload %s, got %s", tt.name, payload, raw)
+			}
+		}
+	}
+}
+
+func TestSetErrorHandler(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	type failure struct {
+		raw string
+		err error
+	}
+	var failures []failure
+	r.SetErrorHandler(func(raw []byte, err error) {
+		failures = append(failures, failure{string(raw), err})
+	})
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	var zBuf bytes.Buffer
+	zw := gzip.NewWriter(&zBuf)
+	zw.Write([]byte(`{"not": gelf`))
+	zw.Close()
+
+	conn.Write([]byte("garbage"))
+	conn.Write(zBuf.Bytes())
+	conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"good"}`))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "good" {
+		t.Errorf("msg.Short: expected good, got %s", msg.Short)
+	}
+
+	if len(failures) != 2 {
+		t.Fatalf("expected 2 failures, got %v", failures)
+	}
+	if failures[0].raw != "garbage" || !errors.Is(failures[0].err, ErrJSONDecode) {
+		t.Errorf("unexpected failure %+v", failures[0])
+	}
+	if failures[1].raw != `{"not": gelf` || !errors.Is(failures[1].err, ErrJSONDecode) {
+		t.Errorf("expected the failed message decompressed, got %+v", failures[1])
+	}
+	if s := r.Stats(); s.DecodeErrors != 2 {
+		t.Errorf("DecodeErrors: expected 2, got %d", s.DecodeErrors)
+	}
+
+	// without a handler, the error is returned
+	r.SetErrorHandler(nil)
+	conn.Write([]byte("garbage"))
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrJSONDecode) {
+		t.Errorf("expected ErrJSONDecode, got %v", err)
+	}
+}
+
+func TestWithExpvar(t *testing.T) {
+	// expvar names stay taken for good, even across -count runs
+	ns := fmt.Sprint("gelf.test.reader", time.Now().UnixNano())
+
+	// a reader that fails to open leaves the namespace free
+	taken, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer taken.Close()
+	if _, err = NewReader(taken.Addr(), WithExpvar(ns)); err == nil {
+		t.Fatalf("NewReader listened on an address in use")
+	}
+	if expvar.Get(ns+".received") != nil {
+		t.Errorf("namespace published by a reader that failed to open")
+	}
+
+	r, err := NewReader("127.0.0.1:0", WithExpvar(ns))
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	if _, err = NewReader("127.0.0.1:0", WithExpvar(ns)); err == nil {
+		t.Errorf("NewReader accepted a namespace already published")
+	}
+	if _, err = NewReader("127.0.0.1:0", WithExpvar("")); err == nil {
+		t.Errorf("NewReader accepted an empty namespace")
+	}
+
+	datagram := `{"version":"1.1","host":"h","short_message":"counted"}`
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(datagram))
+	conn.Write([]byte("garbage"))
+	r.ReadMessage()
+	r.ReadMessage()
+
+	expected := map[string]string{
+		"received":      "2",
+		"bytes":         fmt.Sprint(len(datagram) + len("garbage")),
+		"decode_errors": "1",
+		"dropped":       "0",
+	}
+	for name, value := range expected {
+		v := expvar.Get(ns + "." + name)
+		if v == nil {
+			t.Errorf("%s not published", name)
+			continue
+		}
+		if v.String() != value {
+			t.Errorf("%s: expected %s, got %s", name, value, v)
+		}
+	}
+}
+
+func TestSetDefaultVersion(t *testing.T) {
+	r, err := newReader(&replayConn{}, nil)
+	if err != nil {
+		t.Fatalf("newReader: %s", err)
+	}
+	conn := r.conn.(*replayConn)
+	r.SetStrict(true)
+
+	if err = r.SetDefaultVersion("2.0"); err == nil {
+		t.Errorf("SetDefaultVersion accepted 2.0")
+	}
+
+	conn.datagram = []byte(`{"host":"h","short_message":"s"}`)
+	if _, err = r.ReadMessage(); err == nil {
+		t.Errorf("strict reader accepted a message without version")
+	}
+
+	if err = r.SetDefaultVersion("1.1"); err != nil {
+		t.Fatalf("SetDefaultVersion: %s", err)
+	}
+	tests := map[string]string{
+		`{"host":"h","short_message":"s"}`:                 "1.1",
+		`{"version":"","host":"h","short_message":"s"}`:    "1.1",
+		`{"version":"1.0","host":"h","short_message":"s"}`: "1.0",
+	}
+	for datagram, expected := range tests {
+		conn.datagram = []byte(datagram)
+		msg, raw, err := r.ReadMessageRaw()
+		if err != nil {
+			t.Errorf("%s: ReadMessage: %s", datagram, err)
+			continue
+		}
+		if msg.Version != expected {
+			t.Errorf("%s: Version: expected %s, got %s", datagram, expected, msg.Version)
+		}
+		if string(raw) != datagram {
+			t.Errorf("%s: raw JSON changed to %s", datagram, raw)
+		}
+	}
+}
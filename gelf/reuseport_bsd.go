@@ -0,0 +1,11 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gelf
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,10 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package gelf
+
+// SO_REUSEPORT, which the syscall package doesn't define for Linux.
+const soReusePort = 0x200
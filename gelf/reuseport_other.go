@@ -0,0 +1,18 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package gelf
+
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenUDPReusePort(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,38 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gelf
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+// listenUDPReusePort is net.ListenUDP, with SO_REUSEPORT set on the
+// socket before it is bound.
+func listenUDPReusePort(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import "fmt"
+
+// SetSampleRate makes w send only one in n of the messages of the
+// given level and the less severe ones, to cap the volume a flood of
+// logs puts on the server; more severe messages are always sent.
+// Sampling is deterministic: the first sampled message is sent, then
+// every nth one after it, whatever its level.  The messages not sent
+// are counted by SampledOut, and aren't reported as errors.  An n of
+// 0 or 1, the default, sends every message.
+func (w *Writer) SetSampleRate(n int, level int32) error {
+	if n < 0 {
+		return fmt.Errorf("invalid sample rate %d", n)
+	}
+	if level < LevelEmergency || level > LevelDebug {
+		return fmt.Errorf("invalid sample level %d", level)
+	}
+	w.sampleRate = n
+	w.sampleLevel = level
+	return nil
+}
+
+// SampledOut returns the number of messages w didn't send because of
+// SetSampleRate.
+func (w *Writer) SampledOut() uint64 {
+	return w.sampledOut.Load()
+}
+
+// sampleOut reports whether m is to be dropped by sampling, counting
+// it if so.
+func (w *Writer) sampleOut(m *Message) bool {
+	if w.sampleRate <= 1 || m.Level < w.sampleLevel {
+		return false
+	}
+	if (w.sampleSeq.Add(1)-1)%uint64(w.sampleRate) == 0 {
+		return false
+	}
+	w.sampledOut.Add(1)
+	return true
+}
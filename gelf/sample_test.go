@@ -0,0 +1,62 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import "testing"
+
+func TestSampleRate(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+
+	if err = w.SetSampleRate(-1, LevelInfo); err == nil {
+		t.Errorf("SetSampleRate accepted a negative rate")
+	}
+	if err = w.SetSampleRate(10, LevelDebug+1); err == nil {
+		t.Errorf("SetSampleRate accepted an unknown level")
+	}
+	if err = w.SetSampleRate(10, LevelInfo); err != nil {
+		t.Fatalf("SetSampleRate: %s", err)
+	}
+
+	// 100 sampled messages, half of them debug, and 5 errors
+	for i := 0; i < 100; i++ {
+		level := LevelInfo
+		if i%2 == 1 {
+			level = LevelDebug
+		}
+		if i%20 == 0 {
+			w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "e", Level: LevelError})
+		}
+		if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "s", Level: level}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	w.Close()
+
+	var sampled, errs int
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			break
+		}
+		if msg.Level == LevelError {
+			errs++
+		} else {
+			sampled++
+		}
+	}
+	if errs != 5 {
+		t.Errorf("expected the 5 errors to be sent, got %d", errs)
+	}
+	if sampled != 10 {
+		t.Errorf("expected 10 sampled messages to be sent, got %d", sampled)
+	}
+	if out := w.SampledOut(); out != 90 {
+		t.Errorf("SampledOut: expected 90, got %d", out)
+	}
+}
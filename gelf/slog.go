@@ -0,0 +1,201 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageWriter sends GELF messages.  Writer and AsyncWriter are both
+// MessageWriters.
+type MessageWriter interface {
+	WriteMessage(m *Message) error
+}
+
+// GELFHandler is a slog.Handler that sends every record as a GELF
+// message.  The record's message becomes the short message, and its
+// attributes become additional fields.  Since GELF has no nested
+// fields, the attributes of groups are flattened into dotted names
+// ("request.method"), and their values are sent as numbers or strings.
+type GELFHandler struct {
+	w      MessageWriter
+	opts   slog.HandlerOptions
+	host   string
+	prefix string                 // names of the open groups, dot-terminated
+	extra  map[string]interface{} // from WithAttrs
+}
+
+// NewGELFHandler returns a handler sending records through w.  Only
+// the Level and AddSource options are used; opts may be nil.
+func NewGELFHandler(w MessageWriter, opts *slog.HandlerOptions) *GELFHandler {
+	h := &GELFHandler{w: w}
+	if opts != nil {
+		h.opts = *opts
+	}
+	h.host, _ = os.Hostname()
+	return h
+}
+
+// Enabled reports whether records of the given level are sent.
+func (h *GELFHandler) Enabled(_ context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.opts.Level != nil {
+		min = h.opts.Level.Level()
+	}
+	return level >= min
+}
+
+// Handle sends r as a GELF message.
+func (h *GELFHandler) Handle(_ context.Context, r slog.Record) error {
+	m := &Message{
+		Version: "1.1",
+		Host:    h.host,
+		Short:   r.Message,
+		Level:   slogLevel(r.Level),
+	}
+	if !r.Time.IsZero() {
+		m.SetTime(r.Time)
+	}
+	if h.opts.AddSource && r.PC != 0 {
+		frames := runtime.CallersFrames([]uintptr{r.PC})
+		f, _ := frames.Next()
+		m.File = f.File
+		m.Line = int32(f.Line)
+	}
+
+	if len(h.extra) > 0 || r.NumAttrs() > 0 {
+		m.Extra = make(map[string]interface{}, len(h.extra)+r.NumAttrs())
+		for k, v := range h.extra {
+			m.Extra[k] = v
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(m.Extra, h.prefix, a)
+			return true
+		})
+	}
+
+	return h.w.WriteMessage(m)
+}
+
+// WithAttrs returns a handler adding attrs to every message, within
+// the groups h has open.
+func (h *GELFHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	h2 := *h
+	h2.extra = make(map[string]interface{}, len(h.extra)+len(attrs))
+	for k, v := range h.extra {
+		h2.extra[k] = v
+	}
+	for _, a := range attrs {
+		addAttr(h2.extra, h.prefix, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a handler prefixing the names of the attributes
+// added afterwards with name and a dot.
+func (h *GELFHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.prefix = h.prefix + fieldName(name) + "."
+	return &h2
+}
+
+// slogLevel maps a slog level to the closest syslog severity.
+func slogLevel(l slog.Level) int32 {
+	switch {
+	case l >= slog.LevelError:
+		return LevelError
+	case l >= slog.LevelWarn:
+		return LevelWarning
+	case l > slog.LevelInfo:
+		return LevelNotice
+	case l >= slog.LevelInfo:
+		return LevelInfo
+	}
+	return LevelDebug
+}
+
+// addAttr adds a to extra, named with prefix, flattening groups.
+func addAttr(extra map[string]interface{}, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+
+	if v.Kind() == slog.KindGroup {
+		attrs := v.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		// an unnamed group's attributes are inlined
+		if a.Key != "" {
+			prefix += fieldName(a.Key) + "."
+		}
+		for _, ga := range attrs {
+			addAttr(extra, prefix, ga)
+		}
+		return
+	}
+
+	if a.Key == "" {
+		return
+	}
+	extra[prefix+fieldName(a.Key)] = slogValue(v)
+}
+
+// slogValue converts v to a number or string, the only kinds of
+// values GELF fields may have.
+func slogValue(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindInt64:
+		return v.Int64()
+	case slog.KindUint64:
+		return v.Uint64()
+	case slog.KindFloat64:
+		return v.Float64()
+	case slog.KindString:
+		return v.String()
+	case slog.KindBool:
+		return strconv.FormatBool(v.Bool())
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	}
+
+	switch x := v.Any().(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// fieldName replaces the characters GELF doesn't allow in field names
+// with underscores: only letters, digits, underscores, dashes and
+// dots are allowed.
+func fieldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,95 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// messageRecorder keeps the messages written to it.
+type messageRecorder []*Message
+
+func (r *messageRecorder) WriteMessage(m *Message) error {
+	*r = append(*r, m)
+	return nil
+}
+
+func TestGELFHandler(t *testing.T) {
+	var rec messageRecorder
+	logger := slog.New(NewGELFHandler(&rec, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	logger = logger.With("app", "api").WithGroup("req").With("method", "GET")
+	logger.Warn("slow request",
+		"took", 1500*time.Millisecond,
+		slog.Group("user", "id", 42, "admin", true),
+		"err", errors.New("timeout"),
+		"bad key", 1.5)
+
+	if len(rec) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(rec))
+	}
+	m := rec[0]
+	if m.Short != "slow request" {
+		t.Errorf("m.Short: expected slow request, got %s", m.Short)
+	}
+	if m.Level != LevelWarning {
+		t.Errorf("m.Level: expected %d, got %d", LevelWarning, m.Level)
+	}
+	if time.Since(m.Time()) > time.Minute {
+		t.Errorf("m.Time: expected about now, got %s", m.Time())
+	}
+
+	expected := map[string]interface{}{
+		"app":            "api",
+		"req.method":     "GET",
+		"req.took":       "1.5s",
+		"req.user.id":    int64(42),
+		"req.user.admin": "true",
+		"req.err":        "timeout",
+		"req.bad_key":    1.5,
+	}
+	if len(m.Extra) != len(expected) {
+		t.Errorf("m.Extra: expected %v, got %v", expected, m.Extra)
+	}
+	for k, v := range expected {
+		if m.Extra[k] != v {
+			t.Errorf("m.Extra[%q]: expected %v, got %v", k, v, m.Extra[k])
+		}
+	}
+
+	if _, err := m.MarshalJSON(); err != nil {
+		t.Errorf("MarshalJSON: %s", err)
+	}
+}
+
+func TestSlogLevel(t *testing.T) {
+	for l, expected := range map[slog.Level]int32{
+		slog.LevelDebug:     LevelDebug,
+		slog.LevelInfo:      LevelInfo,
+		slog.LevelInfo + 2:  LevelNotice,
+		slog.LevelWarn:      LevelWarning,
+		slog.LevelError:     LevelError,
+		slog.LevelError + 4: LevelError,
+	} {
+		if level := slogLevel(l); level != expected {
+			t.Errorf("slogLevel(%s): expected %d, got %d", l, expected, level)
+		}
+	}
+}
+
+func TestGELFHandlerEnabled(t *testing.T) {
+	var rec messageRecorder
+	logger := slog.New(NewGELFHandler(&rec, nil))
+
+	logger.Debug("hidden")
+	logger.Info("shown")
+
+	if len(rec) != 1 || rec[0].Short != "shown" {
+		t.Errorf("expected only the info message, got %d messages", len(rec))
+	}
+}
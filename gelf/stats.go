@@ -0,0 +1,119 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ReaderStats counts what a Reader has received since it was created.
+type ReaderStats struct {
+	Received     uint64 // datagrams read
+	Bytes        uint64 // size of the datagrams read
+	Chunked      uint64 // datagrams that were chunks of a chunked message
+	Reassembled  uint64 // chunked messages whose chunks all arrived
+	Incomplete   uint64 // chunked messages dropped as chunks were missing
+	Dropped      uint64 // messages lost before decoding, Incomplete ones included
+	DecodeErrors uint64 // messages that could not be decompressed or decoded
+	Overflowed   uint64 // messages discarded because Messages was full
+}
+
+// readerCounters holds the live counters behind ReaderStats.
+type readerCounters struct {
+	received, bytes, chunked, reassembled         atomic.Uint64
+	incomplete, dropped, decodeErrors, overflowed atomic.Uint64
+}
+
+// Stats returns a snapshot of the reader's counters.  It may be
+// called concurrently with reads.
+func (r *Reader) Stats() ReaderStats {
+	c := &r.counters
+	return ReaderStats{
+		Received:     c.received.Load(),
+		Bytes:        c.bytes.Load(),
+		Chunked:      c.chunked.Load(),
+		Reassembled:  c.reassembled.Load(),
+		Incomplete:   c.incomplete.Load(),
+		Dropped:      c.dropped.Load(),
+		DecodeErrors: c.decodeErrors.Load(),
+		Overflowed:   c.overflowed.Load(),
+	}
+}
+
+// WithExpvar publishes the reader's counters with the expvar package,
+// as namespace.received, namespace.bytes, namespace.chunked,
+// namespace.reassembled, namespace.incomplete, namespace.dropped,
+// namespace.decode_errors and namespace.overflowed, which are then
+// served on /debug/vars along with the other expvar variables.  Every
+// reader needs a namespace of its own, like "gelf.reader" or
+// "gelf.reader.audit": expvar variables can't be removed, so a
+// namespace stays taken, showing the final counts, after its reader
+// is closed.
+func WithExpvar(namespace string) ReaderOption {
+	return func(r *Reader) error {
+		if namespace == "" {
+			return fmt.Errorf("WithExpvar: empty namespace")
+		}
+		if err := checkExpvar(namespace); err != nil {
+			return err
+		}
+		// published once the reader is open, so that a reader failing
+		// to open doesn't take the namespace
+		r.expvarNamespace = namespace
+		return nil
+	}
+}
+
+// expvarStats are the counters WithExpvar publishes, by name.
+var expvarStats = map[string]func(ReaderStats) uint64{
+	"received":      func(s ReaderStats) uint64 { return s.Received },
+	"bytes":         func(s ReaderStats) uint64 { return s.Bytes },
+	"chunked":       func(s ReaderStats) uint64 { return s.Chunked },
+	"reassembled":   func(s ReaderStats) uint64 { return s.Reassembled },
+	"incomplete":    func(s ReaderStats) uint64 { return s.Incomplete },
+	"dropped":       func(s ReaderStats) uint64 { return s.Dropped },
+	"decode_errors": func(s ReaderStats) uint64 { return s.DecodeErrors },
+	"overflowed":    func(s ReaderStats) uint64 { return s.Overflowed },
+}
+
+// checkExpvar fails if a name of namespace is taken, since
+// expvar.Publish panics on those.
+func checkExpvar(namespace string) error {
+	for name := range expvarStats {
+		if expvar.Get(namespace+"."+name) != nil {
+			return fmt.Errorf("WithExpvar: %s.%s is already published", namespace, name)
+		}
+	}
+	return nil
+}
+
+// expvarMu serializes publishing, so that two readers can't both find
+// a namespace free.
+var expvarMu sync.Mutex
+
+// publishExpvar publishes r's counters under the namespace set by
+// WithExpvar, if any.
+func (r *Reader) publishExpvar() error {
+	if r.expvarNamespace == "" {
+		return nil
+	}
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if err := checkExpvar(r.expvarNamespace); err != nil {
+		return err
+	}
+	for name, get := range expvarStats {
+		get := get
+		expvar.Publish(r.expvarNamespace+"."+name, expvar.Func(func() interface{} {
+			return get(r.Stats())
+		}))
+	}
+	return nil
+}
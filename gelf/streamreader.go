@@ -0,0 +1,83 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Longest line a StreamReader accepts, unless changed with
+// SetMaxLineSize.
+const defaultMaxLineSize = 1 << 20
+
+// StreamReader reads GELF messages from a stream holding one message
+// per line, like the spool files of some shipping agents.  Lines are
+// decompressed as a Reader would decompress datagrams, but they are
+// usually plain JSON: compressed data may contain newlines itself.
+type StreamReader struct {
+	src         io.Reader
+	scanner     *bufio.Scanner
+	maxLineSize int
+	dec         decoder
+}
+
+// NewStreamReader returns a StreamReader reading from r.
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{src: r, maxLineSize: defaultMaxLineSize, dec: newDecoder()}
+}
+
+// SetMaxLineSize sets the longest line, in bytes, that can be read;
+// the default is 1 MiB.  It must be called before the first
+// ReadMessage.
+func (sr *StreamReader) SetMaxLineSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid max line size %d", n)
+	}
+	if sr.scanner != nil {
+		return fmt.Errorf("SetMaxLineSize: reading already started")
+	}
+	sr.maxLineSize = n
+	return nil
+}
+
+// ReadMessage returns the message on the next non-blank line, or
+// io.EOF at the end of the stream.  A line that can't be decoded is
+// reported as an error, and the next call moves on to the following
+// line.  A line longer than the maximum line size ends the stream with
+// bufio.ErrTooLong.
+func (sr *StreamReader) ReadMessage() (*Message, error) {
+	if sr.scanner == nil {
+		sr.scanner = bufio.NewScanner(sr.src)
+		initial := 64 << 10
+		if initial > sr.maxLineSize {
+			initial = sr.maxLineSize
+		}
+		sr.scanner.Buffer(make([]byte, initial), sr.maxLineSize)
+	}
+
+	for sr.scanner.Scan() {
+		line := bytes.TrimSpace(sr.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		mapped, err := sr.dec.decode(line)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := new(Message)
+		msg.fromMap(mapped)
+		return msg, nil
+	}
+
+	if err := sr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
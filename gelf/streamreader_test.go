@@ -0,0 +1,63 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStreamReader(t *testing.T) {
+	long := strings.Repeat("x", 200<<10)
+	sr := NewStreamReader(strings.NewReader(
+		`{"version":"1.1","host":"h","short_message":"first","_n":1}` + "\n" +
+			"\n" +
+			`{"version":` + "\r\n" +
+			`{"version":"1.1","host":"h","short_message":"` + long + `"}` + "\n" +
+			`{"version":"1.1","host":"h","short_message":"last"}`))
+
+	msg, err := sr.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "first" || msg.Extra["n"] == nil {
+		t.Errorf("expected message first with field n, got %+v", msg)
+	}
+
+	if _, err = sr.ReadMessage(); !errors.Is(err, ErrJSONDecode) {
+		t.Errorf("expected ErrJSONDecode for a broken line, got %v", err)
+	}
+
+	for _, expected := range []string{long, "last"} {
+		msg, err = sr.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("expected a %d byte short message, got %d bytes", len(expected), len(msg.Short))
+		}
+	}
+
+	if _, err = sr.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestStreamReaderMaxLineSize(t *testing.T) {
+	sr := NewStreamReader(strings.NewReader(`{"short_message":"` + strings.Repeat("x", 100) + `"}`))
+	if err := sr.SetMaxLineSize(64); err != nil {
+		t.Fatalf("SetMaxLineSize: %s", err)
+	}
+
+	if _, err := sr.ReadMessage(); err != bufio.ErrTooLong {
+		t.Errorf("expected bufio.ErrTooLong, got %v", err)
+	}
+	if err := sr.SetMaxLineSize(128); err == nil {
+		t.Errorf("SetMaxLineSize after reading: expected an error")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// TCPReader receives GELF messages sent over TCP, where every message
+// is an uncompressed JSON document terminated by a null byte, or
+// prefixed by its length with WithTCPFraming.  Any number of clients
+// may be connected at once; the messages decoded from all of them are
+// multiplexed onto a single stream drained by ReadMessage.
+type TCPReader struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	frames   chan tcpFrame
+	done     chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+
+	framing      TCPFraming
+	maxFrameSize int
+}
+
+// TCPReaderOption configures a TCPReader at construction time.
+type TCPReaderOption func(*TCPReader) error
+
+// TCPFraming is how messages are delimited in a TCP stream.
+type TCPFraming int
+
+const (
+	// NullDelimited terminates every message with a null byte, as the
+	// GELF spec says.
+	NullDelimited TCPFraming = iota
+	// LengthPrefixed precedes every message with its length in bytes,
+	// as a 4 byte big-endian integer.
+	LengthPrefixed
+)
+
+// Largest length-prefixed frame accepted, unless set with
+// WithMaxFrameSize.
+const defaultMaxFrameSize = 1 << 20
+
+// WithTCPFraming sets how the messages sent to the reader are framed;
+// NullDelimited is the default.  All of the reader's clients must
+// frame them the same way.
+func WithTCPFraming(framing TCPFraming) TCPReaderOption {
+	return func(r *TCPReader) error {
+		if framing != NullDelimited && framing != LengthPrefixed {
+			return fmt.Errorf("unknown TCP framing %d", framing)
+		}
+		r.framing = framing
+		return nil
+	}
+}
+
+// WithMaxFrameSize sets the largest size of a frame, not counting its
+// terminator or length prefix, 1MiB by default.  A larger one, or a
+// LengthPrefixed frame claiming to be, is reported as
+// ErrMessageTooLarge, and its connection closed, since the rest of the
+// stream can't be trusted to be framed.
+func WithMaxFrameSize(n int) TCPReaderOption {
+	return func(r *TCPReader) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max frame size %d", n)
+		}
+		r.maxFrameSize = n
+		return nil
+	}
+}
+
+// tcpFrame is the outcome of decoding a single frame.
+type tcpFrame struct {
+	msg *Message
+	err error
+}
+
+// NewTCPReader listens for GELF TCP connections on addr.
+func NewTCPReader(addr string, opts ...TCPReaderOption) (*TCPReader, error) {
+	r, err := configureTCPReader(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %s", err)
+	}
+
+	r.start(l)
+	return r, nil
+}
+
+// configureTCPReader returns a TCPReader with opts applied, not yet
+// listening.
+func configureTCPReader(opts []TCPReaderOption) (*TCPReader, error) {
+	r := &TCPReader{
+		conns:        make(map[net.Conn]struct{}),
+		frames:       make(chan tcpFrame),
+		done:         make(chan struct{}),
+		maxFrameSize: defaultMaxFrameSize,
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// start makes r accept connections on l.
+func (r *TCPReader) start(l net.Listener) {
+	r.listener = l
+
+	r.wg.Add(1)
+	go r.acceptLoop()
+}
+
+// Addr returns the address the reader listens on, or "" once it is
+// closed.
+func (r *TCPReader) Addr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listener == nil || r.closed {
+		return ""
+	}
+	return r.listener.Addr().String()
+}
+
+// ReadMessage returns the next message received on any of the
+// reader's connections, blocking until one arrives.  A frame that
+// cannot be decoded is reported as an error; the connection it came
+// from stays open.
+func (r *TCPReader) ReadMessage() (*Message, error) {
+	select {
+	case f := <-r.frames:
+		return f.msg, f.err
+	case <-r.done:
+		return nil, ErrReaderClosed
+	}
+}
+
+// Close stops accepting connections and closes those already
+// accepted.  Blocked and subsequent ReadMessage calls return
+// ErrReaderClosed.
+func (r *TCPReader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	err := r.listener.Close()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	return err
+}
+
+func (r *TCPReader) acceptLoop() {
+	defer r.wg.Done()
+
+	for {
+		c, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			c.Close()
+			return
+		}
+		r.conns[c] = struct{}{}
+		r.wg.Add(1)
+		r.mu.Unlock()
+
+		go r.serve(c)
+	}
+}
+
+// serve splits the stream read from c into frames and decodes every
+// one, until c is closed by either end.  bufio takes care of frames
+// spanning several TCP reads.
+func (r *TCPReader) serve(c net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		r.mu.Unlock()
+		c.Close()
+	}()
+
+	br := bufio.NewReader(c)
+	for {
+		frame, err := r.readFrame(br)
+
+		var f tcpFrame
+		switch {
+		case err == ErrMessageTooLarge:
+			f.err = err
+		case len(bytes.TrimSpace(frame)) > 0:
+			f.msg, f.err = decodeTCPFrame(frame)
+		}
+
+		if f.msg != nil || f.err != nil {
+			select {
+			case r.frames <- f:
+			case <-r.done:
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readFrame returns the next frame, without its delimiter.  A null
+// delimited frame cut short by the end of the stream is returned as
+// well, with the error.
+func (r *TCPReader) readFrame(br *bufio.Reader) ([]byte, error) {
+	if r.framing == NullDelimited {
+		var frame []byte
+		for {
+			part, err := br.ReadSlice(0)
+			n := len(frame) + len(part)
+			if err == nil {
+				n-- // the terminator
+			}
+			if n > r.maxFrameSize {
+				return nil, ErrMessageTooLarge
+			}
+			frame = append(frame, part...)
+			if err != bufio.ErrBufferFull {
+				if err == nil {
+					frame = frame[:len(frame)-1]
+				}
+				return frame, err
+			}
+		}
+	}
+
+	var prefix [4]byte
+	if _, err := io.ReadFull(br, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if int64(n) > int64(r.maxFrameSize) {
+		return nil, ErrMessageTooLarge
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(br, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func decodeTCPFrame(frame []byte) (*Message, error) {
+	msg := new(Message)
+
+	if err := msg.UnmarshalJSON(frame); err != nil {
+		return nil, fmt.Errorf("%w: json.Unmarshal: %w", ErrJSONDecode, err)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tests frames split across writes, several frames per write and
+// several concurrent clients
+func TestTCPReaderFraming(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	c1, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c2.Close()
+
+	c1.Write([]byte(`{"version":"1.1","host":"h","short_mes`))
+	c2.Write([]byte(`{"version":"1.1","host":"h","short_message":"b"}` + "\x00" +
+		`{"version":"1.1","host":"h","short_message":"c"}` + "\x00"))
+	time.Sleep(10 * time.Millisecond)
+	c1.Write([]byte(`sage":"a","_x":1}` + "\x00"))
+
+	var shorts []string
+	for i := 0; i < 3; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		shorts = append(shorts, msg.Short)
+		if msg.Short == "a" && msg.Extra["x"] != json.Number("1") {
+			t.Errorf("msg.Extra: expected x=1, got %v", msg.Extra)
+		}
+	}
+
+	sort.Strings(shorts)
+	if shorts[0] != "a" || shorts[1] != "b" || shorts[2] != "c" {
+		t.Errorf("expected messages a, b and c, got %v", shorts)
+	}
+}
+
+func TestTCPReaderAddrAfterClose(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	if r.Addr() == "" {
+		t.Errorf("Addr: expected the listening address")
+	}
+	r.Close()
+	if addr := r.Addr(); addr != "" {
+		t.Errorf("Addr after Close: expected \"\", got %q", addr)
+	}
+}
+
+// lengthPrefixed frames payload as LengthPrefixed does.
+func lengthPrefixed(payload string) []byte {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestTCPReaderNullDelimitedRoundTrip(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0", WithTCPFraming(NullDelimited))
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewTCPWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+
+	for _, short := range []string{"a", "b"} {
+		if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	for _, short := range []string{"a", "b"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != short {
+			t.Errorf("msg.Short: expected %s, got %s", short, msg.Short)
+		}
+	}
+}
+
+func TestTCPReaderLengthPrefixed(t *testing.T) {
+	if _, err := NewTCPReader("127.0.0.1:0", WithTCPFraming(TCPFraming(7))); err == nil {
+		t.Errorf("NewTCPReader accepted an unknown framing")
+	}
+	if _, err := NewTCPReader("127.0.0.1:0", WithMaxFrameSize(0)); err == nil {
+		t.Errorf("NewTCPReader accepted a max frame size of 0")
+	}
+
+	r, err := NewTCPReader("127.0.0.1:0", WithTCPFraming(LengthPrefixed), WithMaxFrameSize(100))
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	c, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c.Close()
+
+	// a null byte within a frame is no delimiter, and a frame may be
+	// split across writes
+	first := lengthPrefixed(`{"version":"1.1","host":"h","short_message":"a\u0000b"}`)
+	c.Write(first[:2])
+	time.Sleep(10 * time.Millisecond)
+	c.Write(first[2:])
+	c.Write(lengthPrefixed(""))
+	c.Write(lengthPrefixed(`{"version":"1.1","host":"h","short_message":"c"}`))
+
+	for _, short := range []string{"a\x00b", "c"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != short {
+			t.Errorf("msg.Short: expected %q, got %q", short, msg.Short)
+		}
+	}
+
+	c.Write(lengthPrefixed(string(make([]byte, 101))))
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection still open after an oversized frame")
+	}
+}
+
+func TestTCPReaderNullDelimitedMaxFrameSize(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0", WithMaxFrameSize(10000))
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	c, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c.Close()
+
+	// larger than the read buffer, but allowed
+	long := strings.Repeat("x", 9000)
+	c.Write([]byte(`{"version":"1.1","host":"h","short_message":"` + long + `"}` + "\x00"))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != long {
+		t.Errorf("msg.Short: expected %d bytes, got %d", len(long), len(msg.Short))
+	}
+
+	// a sender that never terminates its frame
+	go c.Write(bytes.Repeat([]byte("x"), 1<<20))
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
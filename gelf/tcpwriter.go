@@ -0,0 +1,345 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is the state of a Writer's connection to the server.
+type ConnState int
+
+const (
+	// StateConnected means messages are being sent.
+	StateConnected ConnState = iota
+	// StateReconnecting means the connection broke, and messages are
+	// buffered until it is dialed again.
+	StateReconnecting
+	// StateClosed means the Writer was closed.
+	StateClosed
+)
+
+var connStateNames = [...]string{
+	StateConnected:    "connected",
+	StateReconnecting: "reconnecting",
+	StateClosed:       "closed",
+}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(connStateNames) {
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+	return connStateNames[s]
+}
+
+// Reconnection defaults of TCP writers.
+const (
+	defaultReconnectBuffer = 1000
+	defaultBackoffMin      = 100 * time.Millisecond
+	defaultBackoffMax      = 30 * time.Second
+	defaultBackoffJitter   = 0.2
+	dialTimeout            = 5 * time.Second
+)
+
+// tcpTransport sends null-terminated frames over a TCP connection,
+// redialing it when it breaks.
+type tcpTransport struct {
+	addr         string
+	tlsConfig    *tls.Config // nil for plain TCP
+	mu           sync.Mutex
+	conn         net.Conn // nil unless connected
+	state        ConnState
+	pending      [][]byte // frames written while reconnecting
+	maxPending   int
+	dropped      atomic.Uint64
+	backoffMin   time.Duration
+	backoffMax   time.Duration
+	jitter       float64        // fraction of every delay that is random
+	random       func() float64 // in [0, 1), rand.Float64 unless testing
+	writeTimeout time.Duration  // bound on every write, if not zero
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewTCPWriter returns a Writer sending messages to addr over TCP, as
+// uncompressed, null-terminated JSON documents; its CompressionType,
+// CompressionLevel and chunk size are ignored.
+//
+// When sending fails, the Writer redials addr in the background,
+// waiting twice as long after every failed attempt, from 100ms up to
+// 30s, each wait shortened by a random amount of up to 20% so that
+// many writers don't all redial at once; SetBackoff changes that
+// schedule.  Messages written in the meantime, including the one that
+// failed, are buffered and sent once the connection is back, up to
+// SetReconnectBuffer messages; any more are dropped, and counted by
+// ReconnectDropped.  TCP only reports a broken connection on a write
+// after the one that hit it, so a message written just as the server
+// went away may be lost.
+func NewTCPWriter(addr string) (*Writer, error) {
+	return newTCPWriter(addr, nil)
+}
+
+func newTCPWriter(addr string, cfg *tls.Config) (*Writer, error) {
+	w, err := newWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpTransport{
+		addr:       addr,
+		tlsConfig:  cfg,
+		maxPending: defaultReconnectBuffer,
+		backoffMin: defaultBackoffMin,
+		backoffMax: defaultBackoffMax,
+		jitter:     defaultBackoffJitter,
+		random:     rand.Float64,
+		done:       make(chan struct{}),
+	}
+	if t.conn, err = t.dial(); err != nil {
+		return nil, err
+	}
+	w.tcp = t
+
+	return w, nil
+}
+
+// ConnState returns the state of w's connection.  A UDP Writer, with
+// no connection to lose, is always StateConnected.
+func (w *Writer) ConnState() ConnState {
+	if w.tcp == nil {
+		return StateConnected
+	}
+
+	w.tcp.mu.Lock()
+	defer w.tcp.mu.Unlock()
+	return w.tcp.state
+}
+
+// SetReconnectBuffer sets how many messages a TCP Writer buffers while
+// reconnecting; 0 drops them all.
+func (w *Writer) SetReconnectBuffer(messages int) error {
+	if w.tcp == nil {
+		return fmt.Errorf("SetReconnectBuffer: not a TCP writer")
+	}
+	if messages < 0 {
+		return fmt.Errorf("invalid reconnect buffer size %d", messages)
+	}
+
+	w.tcp.mu.Lock()
+	w.tcp.maxPending = messages
+	w.tcp.mu.Unlock()
+
+	return nil
+}
+
+// SetBackoff sets how long a TCP Writer waits between attempts to
+// redial: initial before the first, then twice as long after every
+// failed attempt, up to max.  Every wait is shortened by a random
+// fraction of it, up to jitter, between 0 and 1, so that writers that
+// lost the same server spread their attempts out.  The defaults are
+// 100ms, 30s and 0.2.
+func (w *Writer) SetBackoff(initial, max time.Duration, jitter float64) error {
+	if w.tcp == nil {
+		return fmt.Errorf("SetBackoff: not a TCP writer")
+	}
+	if initial <= 0 || max < initial {
+		return fmt.Errorf("invalid backoff from %s to %s", initial, max)
+	}
+	if jitter < 0 || jitter > 1 {
+		return fmt.Errorf("invalid backoff jitter %g", jitter)
+	}
+
+	w.tcp.mu.Lock()
+	w.tcp.backoffMin = initial
+	w.tcp.backoffMax = max
+	w.tcp.jitter = jitter
+	w.tcp.mu.Unlock()
+
+	return nil
+}
+
+// ReconnectDropped returns the number of messages a TCP Writer dropped
+// because its reconnect buffer was full.
+func (w *Writer) ReconnectDropped() uint64 {
+	if w.tcp == nil {
+		return 0
+	}
+	return w.tcp.dropped.Load()
+}
+
+// write sends frames in a single write, or buffers them if the
+// connection is down.
+func (t *tcpTransport) write(frames ...[]byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case StateClosed:
+		return ErrWriterClosed
+	case StateReconnecting:
+		t.buffer(frames...)
+		return nil
+	}
+
+	data := frames[0]
+	if len(frames) > 1 {
+		data = bytes.Join(frames, nil)
+	}
+
+	t.setDeadline(t.conn)
+	if _, err := t.conn.Write(data); err != nil {
+		t.conn.Close()
+		t.conn = nil
+		t.state = StateReconnecting
+		// a frame that timed out may have been partly sent
+		err = writeError(err)
+		timedOut := errors.Is(err, ErrWriteTimeout)
+		if !timedOut {
+			t.buffer(frames...)
+		}
+
+		t.wg.Add(1)
+		go t.redial()
+
+		if timedOut {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setDeadline sets the deadline of a write on conn about to be made,
+// if t has a write timeout.  t.mu must be held.
+func (t *tcpTransport) setDeadline(conn net.Conn) {
+	if t.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	}
+}
+
+// buffer keeps frames to be sent once reconnected.  t.mu must be
+// held.
+func (t *tcpTransport) buffer(frames ...[]byte) {
+	for _, frame := range frames {
+		if len(t.pending) >= t.maxPending {
+			t.dropped.Add(1)
+			continue
+		}
+		t.pending = append(t.pending, frame)
+	}
+}
+
+// redial dials t.addr until it succeeds in both connecting and
+// sending the buffered frames, or t is closed.
+func (t *tcpTransport) redial() {
+	defer t.wg.Done()
+
+	var delay time.Duration
+	for {
+		var wait time.Duration
+		wait, delay = t.backoff(delay)
+		select {
+		case <-time.After(wait):
+		case <-t.done:
+			return
+		}
+
+		if conn, err := t.dial(); err == nil {
+			if t.resume(conn) {
+				return
+			}
+		}
+	}
+}
+
+// backoff returns how long to wait before the next attempt to redial,
+// given the delay of the previous attempt, zero before the first, and
+// the delay to pass in next time.
+func (t *tcpTransport) backoff(prev time.Duration) (wait, delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delay = t.backoffMin
+	if prev > 0 {
+		delay = 2 * prev
+	}
+	if delay > t.backoffMax {
+		delay = t.backoffMax
+	}
+
+	wait = delay
+	if t.jitter > 0 && t.random != nil {
+		wait -= time.Duration(t.jitter * t.random() * float64(delay))
+	}
+	return wait, delay
+}
+
+// dial connects to t.addr, completing the TLS handshake if t uses
+// TLS.
+func (t *tcpTransport) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if t.tlsConfig != nil {
+		return tls.DialWithDialer(d, "tcp", t.addr, t.tlsConfig)
+	}
+	return d.Dial("tcp", t.addr)
+}
+
+// resume sends the buffered frames on conn, and makes it t's
+// connection if that worked.  It returns whether redialing is over.
+func (t *tcpTransport) resume(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == StateClosed {
+		conn.Close()
+		return true
+	}
+
+	for len(t.pending) > 0 {
+		t.setDeadline(conn)
+		if _, err := conn.Write(t.pending[0]); err != nil {
+			conn.Close()
+			return false
+		}
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+	}
+
+	t.conn = conn
+	t.state = StateConnected
+	return true
+}
+
+// close closes the connection and stops redialing.  Buffered frames
+// are discarded.
+func (t *tcpTransport) close() error {
+	t.mu.Lock()
+	if t.state == StateClosed {
+		t.mu.Unlock()
+		return nil
+	}
+
+	var err error
+	if t.conn != nil {
+		err = t.conn.Close()
+		t.conn = nil
+	}
+	t.state = StateClosed
+	t.pending = nil
+	close(t.done)
+	t.mu.Unlock()
+
+	t.wg.Wait()
+
+	return err
+}
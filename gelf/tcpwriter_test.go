@@ -0,0 +1,367 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startOutage closes r and writes n messages to w, so that w notices
+// the connection is gone.
+func startOutage(t *testing.T, w *Writer, r *TCPReader, n int) {
+	r.Close()
+	for i := 0; i < n; i++ {
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: fmt.Sprint("m", i)}); err != nil {
+			t.Fatalf("WriteMessage during outage: %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if s := w.ConnState(); s != StateReconnecting {
+		t.Fatalf("ConnState: expected reconnecting, got %s", s)
+	}
+}
+
+func TestTCPWriterReconnect(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	addr := r.Addr()
+
+	w, err := NewTCPWriter(addr)
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	w.tcp.backoffMin = 10 * time.Millisecond
+
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "before"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if msg, err := r.ReadMessage(); err != nil || msg.Short != "before" {
+		t.Fatalf("ReadMessage: expected before, got %v, %v", msg, err)
+	}
+
+	startOutage(t, w, r, 5)
+
+	r, err = NewTCPReader(addr)
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	for i := 0; w.ConnState() != StateConnected; i++ {
+		if i == 100 {
+			t.Fatalf("still %s after 1s", w.ConnState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "after"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	// the first messages of the outage may be lost, but the later ones
+	// are sent, in order, before anything written once reconnected
+	var shorts []string
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short == "after" {
+			break
+		}
+		shorts = append(shorts, msg.Short)
+	}
+	if len(shorts) == 0 || shorts[len(shorts)-1] != "m4" {
+		t.Errorf("expected the buffered messages to end with m4, got %v", shorts)
+	}
+}
+
+func TestTCPWriterReconnectBuffer(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+
+	w, err := NewTCPWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	if err = w.SetReconnectBuffer(2); err != nil {
+		t.Fatalf("SetReconnectBuffer: %s", err)
+	}
+
+	// at most one message is lost, two are buffered, and the others
+	// dropped
+	startOutage(t, w, r, 6)
+	if dropped := w.ReconnectDropped(); dropped < 3 {
+		t.Errorf("ReconnectDropped: expected at least 3, got %d", dropped)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if s := w.ConnState(); s != StateClosed {
+		t.Errorf("ConnState: expected closed, got %s", s)
+	}
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "late"}); err != ErrWriterClosed {
+		t.Errorf("WriteMessage after Close: expected ErrWriterClosed, got %v", err)
+	}
+}
+
+func TestWriteMessagesTCP(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewTCPWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+
+	msgs := []*Message{
+		{Version: "1.1", Host: "h", Short: "0"},
+		{Version: "1.1", Host: "h", Short: "1"},
+		{Version: "1.1", Host: "h", Short: "2", Extra: map[string]interface{}{"id": 1}},
+		{Version: "1.1", Host: "h", Short: "3"},
+	}
+	err = w.WriteMessages(msgs)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 2 || !errors.Is(err, ErrReservedField) {
+		t.Fatalf("expected a BatchError for message 2, got %v", err)
+	}
+
+	if err = w.WriteMessages(msgs[3:]); err != nil {
+		t.Fatalf("WriteMessages: %s", err)
+	}
+	for _, expected := range []string{"0", "1", "3"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+}
+
+func benchmarkTCPWrite(b *testing.B, batchSize int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	w, err := NewTCPWriter(l.Addr().String())
+	if err != nil {
+		b.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+
+	batch := make([]*Message, batchSize)
+	for i := range batch {
+		batch[i] = &Message{Version: "1.1", Host: "h", Short: "short message", Level: 6,
+			Extra: map[string]interface{}{"_file": "1234", "_line": "3456"}}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		if batchSize == 1 {
+			err = w.WriteMessage(batch[0])
+		} else {
+			err = w.WriteMessages(batch)
+		}
+		if err != nil {
+			b.Fatalf("write: %s", err)
+		}
+	}
+}
+
+func BenchmarkTCPWriteMessage(b *testing.B) {
+	benchmarkTCPWrite(b, 1)
+}
+
+func BenchmarkTCPWriteMessages(b *testing.B) {
+	benchmarkTCPWrite(b, 100)
+}
+
+func TestWriteRawTCP(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewTCPWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+
+	if err = w.WriteRaw([]byte("{\"short_message\":\"a\x00b\"}")); err == nil {
+		t.Errorf("WriteRaw accepted a payload with a null byte")
+	}
+	if err = w.WriteRaw([]byte(`{"version":"1.1","host":"h","short_message":"raw"}`)); err != nil {
+		t.Fatalf("WriteRaw: %s", err)
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "raw" {
+		t.Errorf("msg.Short: expected raw, got %s", msg.Short)
+	}
+}
+
+func TestTCPWriterWriteTimeout(t *testing.T) {
+	conn := &deadlineConn{stalled: true}
+	tw := &tcpTransport{conn: conn, maxPending: 10, backoffMin: time.Hour, done: make(chan struct{})}
+	w := &Writer{tcp: tw}
+	defer w.Close()
+
+	if err := w.SetWriteTimeout(20 * time.Millisecond); err != nil {
+		t.Fatalf("SetWriteTimeout: %s", err)
+	}
+	err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "slow"})
+	if !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("expected ErrWriteTimeout, got %v", err)
+	}
+
+	// the timed out message isn't kept for resending
+	if s := w.ConnState(); s != StateReconnecting {
+		t.Errorf("ConnState: expected reconnecting, got %s", s)
+	}
+	tw.mu.Lock()
+	pending := len(tw.pending)
+	tw.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("expected no buffered frames, got %d", pending)
+	}
+}
+
+func TestTCPWriterWriteTimeoutReset(t *testing.T) {
+	conn := &deadlineConn{}
+	tw := &tcpTransport{conn: conn, maxPending: 10, backoffMin: time.Hour, done: make(chan struct{})}
+	w := &Writer{tcp: tw}
+	defer w.Close()
+
+	w.SetWriteTimeout(20 * time.Millisecond)
+	if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "fast"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	if err := w.SetWriteTimeout(0); err != nil {
+		t.Fatalf("SetWriteTimeout(0): %s", err)
+	}
+	conn.mu.Lock()
+	conn.stalled = true
+	conn.mu.Unlock()
+	if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "no timeout"}); err != nil {
+		t.Errorf("WriteMessage without a timeout: %s", err)
+	}
+}
+
+func TestSetBackoff(t *testing.T) {
+	tw := &tcpTransport{done: make(chan struct{})}
+	w := &Writer{tcp: tw}
+
+	for _, bad := range []struct {
+		initial, max time.Duration
+		jitter       float64
+	}{
+		{0, time.Second, 0},
+		{time.Second, time.Millisecond, 0},
+		{time.Millisecond, time.Second, -0.1},
+		{time.Millisecond, time.Second, 1.5},
+	} {
+		if err := w.SetBackoff(bad.initial, bad.max, bad.jitter); err == nil {
+			t.Errorf("SetBackoff accepted %s, %s, %g", bad.initial, bad.max, bad.jitter)
+		}
+	}
+	if err := (&Writer{}).SetBackoff(time.Millisecond, time.Second, 0); err == nil {
+		t.Errorf("SetBackoff accepted a UDP writer")
+	}
+
+	if err := w.SetBackoff(100*time.Millisecond, time.Second, 0.5); err != nil {
+		t.Fatalf("SetBackoff: %s", err)
+	}
+
+	// the delay doubles up to max, and the wait is the delay less up
+	// to half of it
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for _, r := range []float64{0, 0.999999} {
+		tw.random = func() float64 { return r }
+		var delay, wait time.Duration
+		for i, e := range expected {
+			e *= time.Millisecond
+			wait, delay = tw.backoff(delay)
+			if delay != e {
+				t.Errorf("random %g, attempt %d: delay: expected %s, got %s", r, i, e, delay)
+			}
+			if wait > delay || wait < delay/2 {
+				t.Errorf("random %g, attempt %d: wait %s out of [%s, %s]", r, i, wait, delay/2, delay)
+			}
+			if r == 0 && wait != delay {
+				t.Errorf("attempt %d: expected no jitter, waited %s", i, wait)
+			}
+		}
+	}
+}
+
+func TestTCPWriterReconnectWithBackoff(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	addr := r.Addr()
+
+	w, err := NewTCPWriter(addr)
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	if err = w.SetBackoff(5*time.Millisecond, 20*time.Millisecond, 1); err != nil {
+		t.Fatalf("SetBackoff: %s", err)
+	}
+
+	startOutage(t, w, r, 3)
+	// several attempts fail while nobody listens
+	time.Sleep(60 * time.Millisecond)
+
+	r, err = NewTCPReader(addr)
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.ConnState() != StateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// NewTLSReader listens for GELF TCP connections secured with TLS on
+// addr.  cfg must hold at least one certificate; to authenticate
+// clients, set its ClientAuth and ClientCAs.  Messages are framed as
+// over plain TCP.
+func NewTLSReader(addr string, cfg *tls.Config, opts ...TCPReaderOption) (*TCPReader, error) {
+	r, err := configureTCPReader(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := tls.Listen("tcp", addr, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %s", err)
+	}
+
+	r.start(l)
+	return r, nil
+}
+
+// NewTLSWriter returns a Writer sending messages to addr as
+// NewTCPWriter does, over a TLS connection configured by cfg; a nil
+// cfg uses the defaults.  To authenticate to the server with a client
+// certificate, set cfg's Certificates.  Reconnecting redoes the
+// handshake with the same cfg.
+func NewTLSWriter(addr string, cfg *tls.Config) (*Writer, error) {
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	return newTCPWriter(addr, cfg)
+}
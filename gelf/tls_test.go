@@ -0,0 +1,104 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a certificate for 127.0.0.1 usable by both
+// servers and clients, and a pool trusting it.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-gelf test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestTLSRoundTrip(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+
+	r, err := NewTLSReader("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("NewTLSReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewTLSWriter(r.Addr(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	})
+	if err != nil {
+		t.Fatalf("NewTLSWriter: %s", err)
+	}
+	defer w.Close()
+
+	m := &Message{Version: "1.1", Host: "h", Short: "over tls",
+		Extra: map[string]interface{}{"_user": "bob"}}
+	if err = w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != m.Short || msg.Extra["user"] != "bob" {
+		t.Errorf("expected %+v, got %+v", m, msg)
+	}
+}
+
+func TestTLSWriterUntrustedServer(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+
+	r, err := NewTLSReader("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("NewTLSReader: %s", err)
+	}
+	defer r.Close()
+
+	if w, err := NewTLSWriter(r.Addr(), nil); err == nil {
+		w.Close()
+		t.Errorf("NewTLSWriter trusted a self-signed certificate")
+	}
+}
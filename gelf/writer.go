@@ -10,15 +10,17 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"crypto/rand"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,12 +30,36 @@ import (
 type Writer struct {
 	mu               sync.Mutex
 	conn             net.Conn
-	hostname         string
+	hostname         string // of messages without one
+	hostnameErr      error  // from os.Hostname, if it failed
 	Facility         string // defaults to current process name
 	CompressionLevel int    // one of the consts from compress/flate
 	CompressionType  CompressType
+	compressMin      int            // smaller messages are sent uncompressed
+	chunkSize        int            // ChunkSize if zero
+	messageID        func() [8]byte // NewMessageID if nil
+	tcp              *tcpTransport
+	staticFields     map[string]interface{} // keys prefixed with "_"
+	version          string                 // of every message, if set
+	extraKeys        ExtraKeyPolicy
+	zlibDict         []byte
+	dictPools        *[flate.BestCompression - flate.DefaultCompression + 1]sync.Pool
+	callerInfo       bool
+	callerSkip       int
+	validateOnly     bool
+	validated        atomic.Uint64
+	codec            JSONCodec     // encoding/json if nil
+	writeTimeout     time.Duration // no deadline if zero
+	sampleRate       int           // send 1 in sampleRate messages, if > 1
+	sampleLevel      int32         // most severe level sampled
+	sampleSeq        atomic.Uint64
+	sampledOut       atomic.Uint64
 }
 
+// ErrWriteTimeout is returned when sending a message took longer than
+// the Writer's SetWriteTimeout.
+var ErrWriteTimeout = errors.New("gelf: write timed out")
+
 // What compression type the writer should use when sending messages
 // to the graylog2 server
 type CompressType int
@@ -44,24 +70,8 @@ const (
 	CompressNone
 )
 
-// Message represents the contents of the GELF message.  It is gzipped
-// before sending.
-type Message struct {
-	Version  string                 `json:"version"`
-	Host     string                 `json:"host"`
-	Short    string                 `json:"short_message"`
-	Full     string                 `json:"full_message,omitempty"`
-	TimeUnix float64                `json:"timestamp"`
-	Level    int32                  `json:"level,omitempty"`
-	Facility string                 `json:"facility,omitempty"`
-	Extra    map[string]interface{} `json:"extra,omitempty"`
-	File     string                 `json:"file,omitempty"`
-	Line     int32                  `json:"line,omitempty"`
-	RawExtra json.RawMessage        `json:"-"`
-}
-
 // Used to control GELF chunking.  Should be less than (MTU - len(UDP
-// header)).
+// header)).  Writer.SetChunkSize overrides it for a single Writer.
 //
 // TODO: generate dynamically using Path MTU Discovery?
 const (
@@ -70,10 +80,15 @@ const (
 	chunkedDataLen   = ChunkSize - chunkedHeaderLen
 )
 
+// The largest UDP payload over IPv4: 65535 bytes, less the 8 byte UDP
+// and 20 byte IP headers.
+const maxChunkSize = 65507
+
 var (
 	magicChunked = []byte{0x1e, 0x0f}
 	magicZlib    = []byte{0x78}
 	magicGzip    = []byte{0x1f, 0x8b}
+	magicZstd    = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
 // Syslog severity levels
@@ -88,29 +103,40 @@ const (
 	LOG_DEBUG   = int32(7)
 )
 
-// numChunks returns the number of GELF chunks necessary to transmit
-// the given compressed buffer.
-func numChunks(b []byte) int {
+// numChunks returns the number of GELF chunks of at most chunkSize
+// bytes necessary to transmit the given compressed buffer.
+func numChunks(b []byte, chunkSize int) int {
 	lenB := len(b)
-	if lenB <= ChunkSize {
+	if lenB <= chunkSize {
 		return 1
 	}
-	return len(b)/chunkedDataLen + 1
+	dataLen := chunkSize - chunkedHeaderLen
+	return (lenB + dataLen - 1) / dataLen
 }
 
 // New returns a new GELF Writer.  This writer can be used to send the
 // output of the standard Go log functions to a central GELF server by
 // passing it to log.SetOutput()
 func NewWriter(addr string) (*Writer, error) {
-	var err error
-	w := new(Writer)
-	w.CompressionLevel = flate.BestSpeed
+	w, err := newWriter()
+	if err != nil {
+		return nil, err
+	}
 
 	if w.conn, err = net.Dial("udp", addr); err != nil {
 		return nil, err
 	}
-	if w.hostname, err = os.Hostname(); err != nil {
-		return nil, err
+
+	return w, nil
+}
+
+// newWriter returns a Writer with its defaults set, but no connection.
+func newWriter() (*Writer, error) {
+	w := new(Writer)
+	w.CompressionLevel = flate.BestSpeed
+
+	if w.hostname, w.hostnameErr = os.Hostname(); w.hostnameErr != nil {
+		w.hostname = "localhost"
 	}
 
 	w.Facility = path.Base(os.Args[0])
@@ -118,63 +144,101 @@ func NewWriter(addr string) (*Writer, error) {
 	return w, nil
 }
 
-// writes the gzip compressed byte array to the connection as a series
-// of GELF chunked messages.  The header format is documented at
+// ChunkMessage splits payload, a serialized and possibly compressed
+// message, into GELF chunk datagrams of at most chunkSize bytes,
+// header included, under a fresh message id from NewMessageID.  The
+// header format is documented at
 // https://github.com/Graylog2/graylog2-docs/wiki/GELF as:
 //
-//     2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
-//     total, chunk-data
-func (w *Writer) writeChunked(zBytes []byte) (err error) {
-	b := make([]byte, 0, ChunkSize)
-	buf := bytes.NewBuffer(b)
-	nChunksI := numChunks(zBytes)
-	if nChunksI > 128 {
-		return fmt.Errorf("msg too large, would need %d chunks", nChunksI)
-	}
-	nChunks := uint8(nChunksI)
-	// use urandom to get a unique message id
-	msgId := make([]byte, 8)
-	n, err := io.ReadFull(rand.Reader, msgId)
-	if err != nil || n != 8 {
-		return fmt.Errorf("rand.Reader: %d/%s", n, err)
-	}
-
-	bytesLeft := len(zBytes)
-	for i := uint8(0); i < nChunks; i++ {
-		buf.Reset()
-		// manually write header.  Don't care about
-		// host/network byte order, because the spec only
-		// deals in individual bytes.
-		buf.Write(magicChunked) //magic
-		buf.Write(msgId)
-		buf.WriteByte(i)
-		buf.WriteByte(nChunks)
-		// slice out our chunk from zBytes
-		chunkLen := chunkedDataLen
-		if chunkLen > bytesLeft {
-			chunkLen = bytesLeft
+//	2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
+//	total, chunk-data
+//
+// A payload needing more than the 128 chunks GELF allows is an error.
+// The datagrams share a single buffer.
+func ChunkMessage(payload []byte, chunkSize int) ([][]byte, error) {
+	return chunkMessage(payload, chunkSize, NewMessageID())
+}
+
+// NewMessageID returns a message id for the chunks of a message, made
+// of 8 bytes from crypto/rand.  Readers tell the chunks of different
+// messages apart by their ids alone, so ids must not collide, even
+// between senders that know nothing of each other, which a counter or
+// the time can't ensure.  Random ids collide with a probability of
+// about n*n/2^65 among n messages being reassembled at once: less
+// than one in a billion for a hundred thousand.
+func NewMessageID() [8]byte {
+	var id [8]byte
+	// crypto/rand.Read never fails
+	rand.Read(id[:])
+	return id
+}
+
+func chunkMessage(payload []byte, chunkSize int, id [8]byte) ([][]byte, error) {
+	if chunkSize <= chunkedHeaderLen || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	dataLen := chunkSize - chunkedHeaderLen
+	nChunks := (len(payload) + dataLen - 1) / dataLen
+	if nChunks == 0 {
+		nChunks = 1
+	}
+	if nChunks > 128 {
+		return nil, fmt.Errorf("msg too large, would need %d chunks", nChunks)
+	}
+
+	buf := make([]byte, 0, len(payload)+nChunks*chunkedHeaderLen)
+	chunks := make([][]byte, nChunks)
+	for i := 0; i < nChunks; i++ {
+		start := len(buf)
+		// Don't care about host/network byte order, because
+		// the spec only deals in individual bytes.
+		buf = append(buf, magicChunked...)
+		buf = append(buf, id[:]...)
+		buf = append(buf, byte(i), byte(nChunks))
+		data := payload[i*dataLen:]
+		if len(data) > dataLen {
+			data = data[:dataLen]
 		}
-		off := int(i) * chunkedDataLen
-		chunk := zBytes[off : off+chunkLen]
-		buf.Write(chunk)
+		buf = append(buf, data...)
+		chunks[i] = buf[start:len(buf):len(buf)]
+	}
 
+	return chunks, nil
+}
+
+// SetMessageIDFunc makes w take the ids of the messages it chunks from
+// f, instead of NewMessageID, which is safest; tests may use it to
+// make the chunks w sends reproducible.  A nil f restores the default.
+func (w *Writer) SetMessageIDFunc(f func() [8]byte) {
+	w.messageID = f
+}
+
+// writes the gzip compressed byte array to the connection as a series
+// of GELF chunked messages, as split by ChunkMessage.
+func (w *Writer) writeChunked(zBytes []byte) (err error) {
+	newID := NewMessageID
+	if w.messageID != nil {
+		newID = w.messageID
+	}
+	chunks, err := chunkMessage(zBytes, w.getChunkSize(), newID())
+	if err != nil {
+		return err
+	}
+
+	nChunks := len(chunks)
+	for i, chunk := range chunks {
 		// write this chunk, and make sure the write was good
-		n, err := w.conn.Write(buf.Bytes())
+		n, err := w.conn.Write(chunk)
 		if err != nil {
-			return fmt.Errorf("Write (chunk %d/%d): %s", i,
-				nChunks, err)
+			return fmt.Errorf("Write (chunk %d/%d): %w", i,
+				nChunks, writeError(err))
 		}
-		if n != len(buf.Bytes()) {
+		if n != len(chunk) {
 			return fmt.Errorf("Write len: (chunk %d/%d) (%d/%d)",
-				i, nChunks, n, len(buf.Bytes()))
+				i, nChunks, n, len(chunk))
 		}
-
-		bytesLeft -= chunkLen
 	}
 
-	if bytesLeft != 0 {
-		return fmt.Errorf("error: %d bytes left after sending", bytesLeft)
-	}
 	return nil
 }
 
@@ -185,6 +249,112 @@ var bufPool = sync.Pool{
 	},
 }
 
+// compressor is a *gzip.Writer or a *zlib.Writer.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Pools of compressors, by compression level, from
+// flate.DefaultCompression to flate.BestCompression.  A compressor
+// allocates hundreds of kilobytes of state, which is worth reusing.
+var (
+	gzipPool [flate.BestCompression - flate.DefaultCompression + 1]sync.Pool
+	zlibPool [flate.BestCompression - flate.DefaultCompression + 1]sync.Pool
+)
+
+func compressorPool(t CompressType, level int) *sync.Pool {
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return nil
+	}
+	if t == CompressGzip {
+		return &gzipPool[level-flate.DefaultCompression]
+	}
+	return &zlibPool[level-flate.DefaultCompression]
+}
+
+// getCompressor returns a compressor of type t, writing to dst at the
+// given level.
+func getCompressor(t CompressType, level int, dst io.Writer) (compressor, error) {
+	if p := compressorPool(t, level); p != nil {
+		if zw, ok := p.Get().(compressor); ok {
+			zw.Reset(dst)
+			return zw, nil
+		}
+	}
+
+	if t == CompressGzip {
+		return gzip.NewWriterLevel(dst, level)
+	}
+	return zlib.NewWriterLevel(dst, level)
+}
+
+// putCompressor returns a closed compressor to its pool, no longer
+// referring to the buffer it wrote to.
+func putCompressor(t CompressType, level int, zw compressor) {
+	if p := compressorPool(t, level); p != nil {
+		zw.Reset(ioutil.Discard)
+		p.Put(zw)
+	}
+}
+
+// getCompressor returns a compressor of type t, at w's level, writing
+// to dst.  zlib compressors use w's dictionary, if it has one.
+func (w *Writer) getCompressor(t CompressType, dst io.Writer) (compressor, error) {
+	if t != CompressZlib || w.zlibDict == nil {
+		return getCompressor(t, w.CompressionLevel, dst)
+	}
+
+	if p := w.dictPool(); p != nil {
+		if zw, ok := p.Get().(compressor); ok {
+			zw.Reset(dst)
+			return zw, nil
+		}
+	}
+	return zlib.NewWriterLevelDict(dst, w.CompressionLevel, w.zlibDict)
+}
+
+func (w *Writer) putCompressor(t CompressType, zw compressor) {
+	if t != CompressZlib || w.zlibDict == nil {
+		putCompressor(t, w.CompressionLevel, zw)
+		return
+	}
+
+	if p := w.dictPool(); p != nil {
+		zw.Reset(ioutil.Discard)
+		p.Put(zw)
+	}
+}
+
+// dictPool returns the pool of w's zlib compressors using its
+// dictionary, at its level; they can't be shared with other Writers,
+// as resetting a compressor keeps its dictionary.
+func (w *Writer) dictPool() *sync.Pool {
+	level := w.CompressionLevel
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return nil
+	}
+	return &w.dictPools[level-flate.DefaultCompression]
+}
+
+// SetZlibDictionary makes w compress zlib messages with dict as preset
+// dictionary.  Short messages repeating the same field names and
+// values, as those of a fleet of similar services do, compress far
+// better with a dictionary holding a typical message.  The receiving
+// end needs the same dictionary, which the zlib header only names by
+// checksum: a Reader must be given it with Reader.SetZlibDictionary,
+// and a server that wasn't can't decode the messages at all.  A nil
+// dict turns the dictionary off.  It must be set before the first
+// message is written.
+func (w *Writer) SetZlibDictionary(dict []byte) {
+	if len(dict) == 0 {
+		w.zlibDict, w.dictPools = nil, nil
+		return
+	}
+	w.zlibDict = append([]byte(nil), dict...)
+	w.dictPools = new([flate.BestCompression - flate.DefaultCompression + 1]sync.Pool)
+}
+
 func newBuffer() *bytes.Buffer {
 	b := bufPool.Get().(*bytes.Buffer)
 	if b != nil {
@@ -199,28 +369,90 @@ func newBuffer() *bytes.Buffer {
 // filled out appropriately.  In general, clients will want to use
 // Write, rather than WriteMessage.
 func (w *Writer) WriteMessage(m *Message) (err error) {
+	m = w.withCaller(m, 1)
+
+	if w.sampleOut(m) {
+		return nil
+	}
+	if w.validateOnly {
+		return w.validate(m)
+	}
+
+	if w.tcp != nil {
+		frame, err := w.tcpFrame(m)
+		if err != nil {
+			return err
+		}
+		return w.tcp.write(frame)
+	}
+
+	m = w.prepare(m)
+
 	mBuf := newBuffer()
 	defer bufPool.Put(mBuf)
-	if err = m.MarshalJSONBuf(mBuf); err != nil {
+	if err = m.marshalJSONBuf(mBuf, w.jsonCodec()); err != nil {
 		return err
 	}
-	mBytes := mBuf.Bytes()
 
+	return w.send(mBuf.Bytes())
+}
+
+// WriteRaw sends payload, an already encoded GELF JSON document, as
+// is: it is compressed and chunked as WriteMessage would, but neither
+// parsed nor given w's static fields or caller info.  Payloads too
+// large to send in 128 chunks are rejected.  With SetValidateOnly,
+// payload is decoded and validated instead.
+func (w *Writer) WriteRaw(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("WriteRaw: empty payload")
+	}
+
+	if w.validateOnly {
+		var m Message
+		if err := m.UnmarshalJSON(payload); err != nil {
+			return fmt.Errorf("WriteRaw: %s", err)
+		}
+		if err := m.Validate(); err != nil {
+			return err
+		}
+		w.validated.Add(1)
+		return nil
+	}
+
+	if w.tcp != nil {
+		if bytes.IndexByte(payload, 0) >= 0 {
+			return fmt.Errorf("WriteRaw: payload contains a null byte")
+		}
+		frame := make([]byte, len(payload)+1)
+		copy(frame, payload)
+		return w.tcp.write(frame)
+	}
+
+	return w.send(payload)
+}
+
+// send compresses mBytes, an encoded message, and writes it in as many
+// datagrams as it takes.
+func (w *Writer) send(mBytes []byte) (err error) {
 	var (
 		zBuf   *bytes.Buffer
 		zBytes []byte
 	)
 
-	var zw io.WriteCloser
-	switch w.CompressionType {
-	case CompressGzip:
-		zBuf = newBuffer()
-		defer bufPool.Put(zBuf)
-		zw, err = gzip.NewWriterLevel(zBuf, w.CompressionLevel)
-	case CompressZlib:
+	compression := w.CompressionType
+	if len(mBytes) < w.compressMin {
+		compression = CompressNone
+	}
+
+	var zw compressor
+	switch compression {
+	case CompressGzip, CompressZlib:
 		zBuf = newBuffer()
 		defer bufPool.Put(zBuf)
-		zw, err = zlib.NewWriterLevel(zBuf, w.CompressionLevel)
+		if zw, err = w.getCompressor(compression, zBuf); err != nil {
+			return
+		}
+		defer w.putCompressor(compression, zw)
 	case CompressNone:
 		zBytes = mBytes
 	default:
@@ -228,23 +460,28 @@ func (w *Writer) WriteMessage(m *Message) (err error) {
 			w.CompressionType))
 	}
 	if zw != nil {
-		if err != nil {
-			return
+		_, err = zw.Write(mBytes)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
 		}
-		if _, err = zw.Write(mBytes); err != nil {
-			zw.Close()
+		if err != nil {
 			return
 		}
-		zw.Close()
 		zBytes = zBuf.Bytes()
 	}
 
-	if numChunks(zBytes) > 1 {
+	if w.writeTimeout > 0 {
+		if err = w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout)); err != nil {
+			return fmt.Errorf("SetWriteDeadline: %s", err)
+		}
+	}
+
+	if numChunks(zBytes, w.getChunkSize()) > 1 {
 		return w.writeChunked(zBytes)
 	}
 	n, err := w.conn.Write(zBytes)
 	if err != nil {
-		return
+		return writeError(err)
 	}
 	if n != len(zBytes) {
 		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
@@ -253,8 +490,405 @@ func (w *Writer) WriteMessage(m *Message) (err error) {
 	return nil
 }
 
+// BatchError is returned by WriteMessages when one of the messages
+// can't be written.  The messages before it were written, and those
+// after it weren't.
+type BatchError struct {
+	Index int // of the message that failed
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("message %d: %s", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// WriteMessages sends msgs as WriteMessage would send each of them.  A
+// TCP Writer sends them all in a single write; over UDP, every message
+// still needs datagrams of its own.  If a message fails, the error is
+// a *BatchError telling which.
+func (w *Writer) WriteMessages(msgs []*Message) error {
+	if w.tcp == nil || w.validateOnly {
+		for i, m := range msgs {
+			if err := w.WriteMessage(w.withCaller(m, 1)); err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	}
+
+	frames := make([][]byte, 0, len(msgs))
+	for i, m := range msgs {
+		if w.sampleOut(m) {
+			continue
+		}
+		frame, err := w.tcpFrame(w.withCaller(m, 1))
+		if err != nil {
+			if len(frames) > 0 {
+				if err := w.tcp.write(frames...); err != nil {
+					return &BatchError{Index: 0, Err: err}
+				}
+			}
+			return &BatchError{Index: i, Err: err}
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) == 0 {
+		return nil
+	}
+	if err := w.tcp.write(frames...); err != nil {
+		return &BatchError{Index: 0, Err: err}
+	}
+	return nil
+}
+
+// validate checks m as WriteMessage would send it, without sending
+// it.
+func (w *Writer) validate(m *Message) error {
+	m = w.prepare(m)
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	mBuf := newBuffer()
+	defer bufPool.Put(mBuf)
+	if err := m.marshalJSONBuf(mBuf, w.jsonCodec()); err != nil {
+		return err
+	}
+
+	w.validated.Add(1)
+	return nil
+}
+
+// SetValidateOnly makes WriteMessage, and Write, check messages
+// without sending them: messages are marshaled and validated as with
+// Message.Validate, and an invalid one is reported as an error.  This
+// allows checking a service's logging in tests or at startup, without
+// a server.  ValidatedMessages counts the messages that would have
+// been sent.
+func (w *Writer) SetValidateOnly(validateOnly bool) {
+	w.validateOnly = validateOnly
+}
+
+// ValidatedMessages returns the number of messages that passed
+// validation while SetValidateOnly was on.
+func (w *Writer) ValidatedMessages() uint64 {
+	return w.validated.Load()
+}
+
+// SetJSONCodec makes w encode messages with c instead of
+// encoding/json.  A nil c restores encoding/json.
+func (w *Writer) SetJSONCodec(c JSONCodec) {
+	w.codec = c
+}
+
+func (w *Writer) jsonCodec() JSONCodec {
+	if w.codec == nil {
+		return stdCodec{}
+	}
+	return w.codec
+}
+
+// tcpFrame encodes m for a TCP Writer: GELF over TCP is neither
+// compressed nor chunked, but null-terminated.
+func (w *Writer) tcpFrame(m *Message) ([]byte, error) {
+	m = w.prepare(m)
+
+	mBuf := newBuffer()
+	defer bufPool.Put(mBuf)
+	if err := m.marshalJSONBuf(mBuf, w.jsonCodec()); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, mBuf.Len()+1)
+	copy(frame, mBuf.Bytes())
+	return frame, nil
+}
+
+// SetCallerInfo makes WriteMessage fill in the File and Line of
+// messages that have no File with the place WriteMessage was called
+// from, skipping skip more frames: a logging function wrapping
+// WriteMessage would use 1, to report its own caller.  A negative skip
+// turns this off again; it is off by default, since looking up the
+// caller has a cost.  Write, once this is on, fills in File and Line
+// with the same caller it reports in the _file and _line fields.
+func (w *Writer) SetCallerInfo(skip int) {
+	w.callerInfo = skip >= 0
+	w.callerSkip = skip
+}
+
+// withCaller returns m with the File and Line of its sender, depth
+// frames above the caller of withCaller, if caller info is on and m
+// has no File.
+func (w *Writer) withCaller(m *Message, depth int) *Message {
+	if !w.callerInfo || m.File != "" {
+		return m
+	}
+
+	_, file, line, ok := runtime.Caller(depth + 1 + w.callerSkip)
+	if !ok {
+		return m
+	}
+
+	mc := *m
+	mc.File, mc.Line = file, int32(line)
+	return &mc
+}
+
+// SetStaticFields sets additional fields added to every message sent,
+// like the name and version of the application.  A field of the
+// message itself overrides a static field of the same name.  Names
+// are prefixed with an underscore if they lack one, and "_id", which
+// GELF reserves, is rejected with ErrReservedField.
+func (w *Writer) SetStaticFields(fields map[string]interface{}) error {
+	static := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if !strings.HasPrefix(k, "_") {
+			k = "_" + k
+		}
+		if k == "_id" {
+			return ErrReservedField
+		}
+		static[k] = v
+	}
+
+	if len(static) == 0 {
+		static = nil
+	}
+	w.staticFields = static
+	return nil
+}
+
+// withStaticFields returns m with w's static fields added to a copy
+// of its extra fields, or m itself if there are none.
+func (w *Writer) withStaticFields(m *Message) *Message {
+	if len(w.staticFields) == 0 {
+		return m
+	}
+
+	extra := make(map[string]interface{}, len(w.staticFields)+len(m.Extra))
+	for k, v := range w.staticFields {
+		extra[k] = v
+	}
+	for k, v := range m.Extra {
+		if !strings.HasPrefix(k, "_") {
+			k = "_" + k
+			if _, ok := m.Extra[k]; ok {
+				// "_foo" wins over "foo", as in MarshalJSON
+				continue
+			}
+		}
+		extra[k] = v
+	}
+
+	mc := *m
+	mc.Extra = extra
+	return &mc
+}
+
+// SetHost sets the host of the messages w sends without one, which by
+// default is that of os.Hostname, or "localhost" if it failed.
+func (w *Writer) SetHost(host string) {
+	w.hostname = host
+}
+
+// HostnameError returns the error os.Hostname failed with when w was
+// created, if it did, in which case w defaults messages to
+// "localhost".
+func (w *Writer) HostnameError() error {
+	return w.hostnameErr
+}
+
+// prepare returns m as w sends it, with w's static fields, version,
+// host and extra key policy applied.
+func (w *Writer) prepare(m *Message) *Message {
+	return w.withExtraKeys(w.withHost(w.withVersion(w.withStaticFields(m))))
+}
+
+// SetExtraKeyPolicy makes w apply policy, as NormalizeExtraKeys does,
+// to the additional fields of the messages it sends; by default,
+// ExtraKeyKeep, they are sent as they are.  The messages passed in
+// aren't modified.
+func (w *Writer) SetExtraKeyPolicy(policy ExtraKeyPolicy) error {
+	switch policy {
+	case ExtraKeyKeep, ExtraKeyReplace, ExtraKeyDrop:
+		w.extraKeys = policy
+		return nil
+	}
+	return fmt.Errorf("unknown extra key policy %d", policy)
+}
+
+// withExtraKeys returns m, or a copy of it with w's extra key policy
+// applied if it has illegal field names.
+func (w *Writer) withExtraKeys(m *Message) *Message {
+	if w.extraKeys == ExtraKeyKeep {
+		return m
+	}
+	for k := range m.Extra {
+		if validExtraKey(k) {
+			continue
+		}
+
+		mc := *m
+		mc.Extra = make(map[string]interface{}, len(m.Extra))
+		for k, v := range m.Extra {
+			mc.Extra[k] = v
+		}
+		mc.NormalizeExtraKeys(w.extraKeys)
+		return &mc
+	}
+	return m
+}
+
+// withHost returns m, or a copy of it with w's host if m has none.
+func (w *Writer) withHost(m *Message) *Message {
+	if m.Host != "" || w.hostname == "" {
+		return m
+	}
+
+	mc := *m
+	mc.Host = w.hostname
+	return &mc
+}
+
+// SetVersion makes w send every message as GELF version v, "1.1" or
+// "1.0", whatever its Version field says; collectors predating GELF
+// 1.1 reject other versions.  By default, messages are sent with
+// their own Version, or "1.1" if it is empty.
+func (w *Writer) SetVersion(v string) error {
+	if v != "1.1" && v != "1.0" {
+		return fmt.Errorf("unsupported GELF version %q", v)
+	}
+	w.version = v
+	return nil
+}
+
+// withVersion returns m, or a copy of it with the version set by
+// SetVersion, or "1.1" if neither sets one.
+func (w *Writer) withVersion(m *Message) *Message {
+	version := w.version
+	if version == "" {
+		if m.Version != "" {
+			return m
+		}
+		version = "1.1"
+	}
+	if m.Version == version {
+		return m
+	}
+
+	mc := *m
+	mc.Version = version
+	return &mc
+}
+
+// SetCompressionType selects how WriteMessage compresses messages.
+// Gzip and zlib output start with their usual magic bytes, and
+// CompressNone sends the raw JSON, all of which Reader recognizes.
+func (w *Writer) SetCompressionType(t CompressType) error {
+	switch t {
+	case CompressGzip, CompressZlib, CompressNone:
+		w.CompressionType = t
+		return nil
+	}
+	return fmt.Errorf("unknown compression type %d", t)
+}
+
+// SetCompressionThreshold makes WriteMessage send messages whose JSON
+// is shorter than n bytes uncompressed, since compressing them costs
+// more CPU than it saves bandwidth, and may even make them longer.
+// The default, 0, compresses every message.
+func (w *Writer) SetCompressionThreshold(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid compression threshold %d", n)
+	}
+	w.compressMin = n
+	return nil
+}
+
+// SetCompressionLevel sets the level used for gzip and zlib
+// compression: flate.NoCompression, flate.DefaultCompression, or
+// anything from flate.BestSpeed to flate.BestCompression.  Lower
+// levels use less CPU per message at the cost of larger datagrams.
+func (w *Writer) SetCompressionLevel(level int) error {
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d", level)
+	}
+	w.CompressionLevel = level
+	return nil
+}
+
+// SetChunkSize sets the size of the datagrams that messages too large
+// for a single datagram are split into, header included.  Chunks are
+// best kept small enough that IP doesn't fragment them, losing the
+// whole chunk if any fragment is lost: the 1420 byte default leaves
+// room for IP, UDP and some tunneling overhead within a 1500 byte
+// Ethernet MTU.  Jumbo frame networks and loopback can use bigger
+// chunks, while VPNs with a small MTU may need smaller ones.  A
+// message is split into at most 128 chunks, so the chunk size also
+// bounds the size of the messages that can be sent.  A Reader accepts
+// datagrams of up to ChunkSize bytes unless WithMaxDatagramSize says
+// otherwise: one reading from a Writer with bigger chunks needs it set
+// to at least n, or rejects them with ErrDatagramTooLarge.
+func (w *Writer) SetChunkSize(n int) error {
+	if n <= chunkedHeaderLen || n > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %d", n)
+	}
+	w.chunkSize = n
+	return nil
+}
+
+// SetWriteTimeout bounds the time sending a single message may take,
+// all of its chunks included, failing with ErrWriteTimeout once d has
+// passed.  A TCP Writer doesn't buffer a message that timed out: the
+// connection is dropped, since part of the message may have been sent,
+// and redialed as when it breaks.  Zero, the default, sets no bound,
+// clearing the deadline left by the previous timeout, if any.
+func (w *Writer) SetWriteTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid write timeout %s", d)
+	}
+	w.writeTimeout = d
+	if d == 0 && w.conn != nil {
+		if err := w.conn.SetWriteDeadline(time.Time{}); err != nil {
+			return fmt.Errorf("SetWriteDeadline: %s", err)
+		}
+	}
+	if w.tcp != nil {
+		w.tcp.mu.Lock()
+		w.tcp.writeTimeout = d
+		if d == 0 && w.tcp.conn != nil {
+			w.tcp.conn.SetWriteDeadline(time.Time{})
+		}
+		w.tcp.mu.Unlock()
+	}
+	return nil
+}
+
+// writeError marks err as ErrWriteTimeout if it is a timeout.
+func writeError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return err
+}
+
+func (w *Writer) getChunkSize() int {
+	if w.chunkSize == 0 {
+		return ChunkSize
+	}
+	return w.chunkSize
+}
+
 // Close connection and interrupt blocked Read or Write operations
 func (w *Writer) Close() error {
+	if w.tcp != nil {
+		return w.tcp.close()
+	}
 	return w.conn.Close()
 }
 
@@ -315,6 +949,21 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	// remove trailing and leading whitespace
 	p = bytes.TrimSpace(p)
 
+	m := lineMessage(p, w.hostname, w.Facility, file, line)
+	if w.callerInfo {
+		m.File, m.Line = file, int32(line)
+	}
+	if err = w.WriteMessage(m); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// lineMessage builds the message sent by Write for p, logged from
+// the given file and line.  p must already be trimmed of surrounding
+// whitespace.
+func lineMessage(p []byte, host, facility, file string, line int) *Message {
 	// If there are newlines in the message, use the first line
 	// for the short message and set the full message to the
 	// original input.  If the input has no newlines, stick the
@@ -326,99 +975,17 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 		full = p
 	}
 
-	m := Message{
+	return &Message{
 		Version:  "1.1",
-		Host:     w.hostname,
+		Host:     host,
 		Short:    string(short),
 		Full:     string(full),
 		TimeUnix: float64(time.Now().Unix()),
 		Level:    6, // info
-		Facility: w.Facility,
+		Facility: facility,
 		Extra: map[string]interface{}{
 			"_file": file,
 			"_line": line,
 		},
 	}
-
-	if err = w.WriteMessage(&m); err != nil {
-		return 0, err
-	}
-
-	return len(p), nil
-}
-
-func (m *Message) MarshalJSONBuf(buf *bytes.Buffer) error {
-	b, err := json.Marshal(m)
-	if err != nil {
-		return err
-	}
-	// write up until the final }
-	if _, err = buf.Write(b[:len(b)-1]); err != nil {
-		return err
-	}
-	if len(m.Extra) > 0 {
-		eb, err := json.Marshal(m.Extra)
-		if err != nil {
-			return err
-		}
-		// merge serialized message + serialized extra map
-		if err = buf.WriteByte(','); err != nil {
-			return err
-		}
-		// write serialized extra bytes, without enclosing quotes
-		if _, err = buf.Write(eb[1 : len(eb)-1]); err != nil {
-			return err
-		}
-	}
-
-	if len(m.RawExtra) > 0 {
-		if err := buf.WriteByte(','); err != nil {
-			return err
-		}
-
-		// write serialized extra bytes, without enclosing quotes
-		if _, err = buf.Write(m.RawExtra[1 : len(m.RawExtra)-1]); err != nil {
-			return err
-		}
-	}
-
-	// write final closing quotes
-	return buf.WriteByte('}')
-}
-
-func (m *Message) UnmarshalJSON(data []byte) error {
-	i := make(map[string]interface{}, 16)
-	if err := json.Unmarshal(data, &i); err != nil {
-		return err
-	}
-	for k, v := range i {
-		if k[0] == '_' {
-			if m.Extra == nil {
-				m.Extra = make(map[string]interface{}, 1)
-			}
-			m.Extra[k] = v
-			continue
-		}
-		switch k {
-		case "version":
-			m.Version = v.(string)
-		case "host":
-			m.Host = v.(string)
-		case "short_message":
-			m.Short = v.(string)
-		case "full_message":
-			m.Full = v.(string)
-		case "timestamp":
-			m.TimeUnix = v.(float64)
-		case "level":
-			m.Level = int32(v.(float64))
-		case "facility":
-			m.Facility = v.(string)
-		case "file":
-			m.File = v.(string)
-		case "line":
-			m.Line = int32(v.(float64))
-		}
-	}
-	return nil
 }
@@ -5,14 +5,22 @@
 package gelf
 
 import (
+	"bytes"
 	"compress/flate"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -337,3 +345,900 @@ func BenchmarkWriteDisableCompressionAndPreencodeExtra(b *testing.B) {
 		})
 	}
 }
+
+func TestNumChunks(t *testing.T) {
+	for n, expected := range map[int]int{
+		0:                    1,
+		ChunkSize:            1,
+		ChunkSize + 1:        2,
+		2 * chunkedDataLen:   2,
+		2*chunkedDataLen + 1: 3,
+	} {
+		if c := numChunks(make([]byte, n), ChunkSize); c != expected {
+			t.Errorf("numChunks(%d bytes): expected %d, got %d", n, expected, c)
+		}
+	}
+}
+
+// tests what WriteMessage puts on the wire: a single gzipped datagram
+// for small messages, GELF chunks for large ones
+func TestWriteMessageDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	w, err := NewWriter(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	randData := make([]byte, 4096)
+	rand.Read(randData)
+	big := base64.StdEncoding.EncodeToString(randData)
+
+	for _, short := range []string{"small", big} {
+		m := &Message{Version: "1.1", Host: "h", Short: short}
+		if err = w.WriteMessage(m); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+
+		var datagrams []byte
+		n := 1
+		for i := 0; i < n; i++ {
+			buf := make([]byte, 65536)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			l, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("ReadFrom: %s", err)
+			}
+			if i == 0 && bytes.HasPrefix(buf, magicChunked) {
+				n = int(buf[2+8+1])
+			}
+			datagrams = append(datagrams, buf[:l]...)
+		}
+
+		chunked := bytes.HasPrefix(datagrams, magicChunked)
+		if chunked != (short == big) {
+			t.Errorf("%d byte message: expected chunked to be %v", len(short), !chunked)
+		}
+		if !chunked && !bytes.HasPrefix(datagrams, magicGzip) {
+			t.Errorf("expected a gzipped datagram, got %q", datagrams)
+		}
+
+		msg, err := DecodeMessage(bytes.NewReader(datagrams))
+		if err != nil {
+			t.Fatalf("DecodeMessage: %s", err)
+		}
+		if msg.Short != short {
+			t.Errorf("msg.Short: expected %d bytes, got %d", len(short), len(msg.Short))
+		}
+	}
+}
+
+func TestSetCompressionType(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	w, err := NewWriter(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	if err = w.SetCompressionType(CompressType(42)); err == nil {
+		t.Errorf("expected an error for an unknown compression type")
+	}
+
+	for ct, magic := range map[CompressType][]byte{
+		CompressGzip: magicGzip,
+		CompressZlib: magicZlib,
+		CompressNone: []byte("{"),
+	} {
+		if err = w.SetCompressionType(ct); err != nil {
+			t.Fatalf("SetCompressionType(%d): %s", ct, err)
+		}
+		if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "compressed"}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+
+		buf := make([]byte, ChunkSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %s", err)
+		}
+		if !bytes.HasPrefix(buf[:n], magic) {
+			t.Errorf("compression %d: expected %x first, got %x", ct, magic, buf[:2])
+		}
+
+		msg, err := DecodeMessage(bytes.NewReader(buf[:n]))
+		if err != nil {
+			t.Fatalf("compression %d: DecodeMessage: %s", ct, err)
+		}
+		if msg.Short != "compressed" {
+			t.Errorf("compression %d: msg.Short: expected compressed, got %s", ct, msg.Short)
+		}
+	}
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	for _, level := range []int{flate.NoCompression, flate.DefaultCompression, flate.BestSpeed, flate.BestCompression} {
+		if err = w.SetCompressionLevel(level); err != nil {
+			t.Errorf("SetCompressionLevel(%d): %s", level, err)
+		}
+		if w.CompressionLevel != level {
+			t.Errorf("CompressionLevel: expected %d, got %d", level, w.CompressionLevel)
+		}
+	}
+
+	for _, level := range []int{flate.HuffmanOnly, flate.BestCompression + 1} {
+		if err = w.SetCompressionLevel(level); err == nil {
+			t.Errorf("SetCompressionLevel(%d): expected an error", level)
+		}
+	}
+	if w.CompressionLevel != flate.BestCompression {
+		t.Errorf("an invalid level changed CompressionLevel to %d", w.CompressionLevel)
+	}
+}
+
+// countingConn counts the bytes written to it instead of sending them.
+type countingConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.n += len(b)
+	return len(b), nil
+}
+
+func BenchmarkWriteCompressionLevels(b *testing.B) {
+	full := strings.Repeat("goroutine 1 [running]:\nmain.main()\n\t/src/main.go:42 +0x1d\n", 20)
+
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		b.Run(strconv.Itoa(level), func(b *testing.B) {
+			conn := new(countingConn)
+			w := &Writer{conn: conn, hostname: "bench"}
+			if err := w.SetCompressionLevel(level); err != nil {
+				b.Fatalf("SetCompressionLevel: %s", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.WriteMessage(&Message{
+					Version:  "1.1",
+					Host:     w.hostname,
+					Short:    "panic: runtime error",
+					Full:     full,
+					TimeUnix: float64(time.Now().Unix()),
+					Level:    3,
+				})
+			}
+			b.ReportMetric(float64(conn.n)/float64(b.N), "wire-bytes/op")
+		})
+	}
+}
+
+func TestSetChunkSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	w, err := NewWriter(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	for _, n := range []int{0, chunkedHeaderLen, maxChunkSize + 1} {
+		if err = w.SetChunkSize(n); err == nil {
+			t.Errorf("SetChunkSize(%d): expected an error", n)
+		}
+	}
+	if err = w.SetChunkSize(512); err != nil {
+		t.Fatalf("SetChunkSize: %s", err)
+	}
+	w.CompressionType = CompressNone
+
+	short := strings.Repeat("x", 2000)
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	var datagrams []byte
+	n := 1
+	for i := 0; i < n; i++ {
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		l, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %s", err)
+		}
+		if l > 512 {
+			t.Errorf("chunk %d: expected at most 512 bytes, got %d", i, l)
+		}
+		if i == 0 {
+			n = int(buf[2+8+1])
+		}
+		datagrams = append(datagrams, buf[:l]...)
+	}
+	// 2000 bytes of short message and some 75 of JSON around it
+	if n != 5 {
+		t.Errorf("expected 5 chunks, got %d", n)
+	}
+
+	msg, err := DecodeMessage(bytes.NewReader(datagrams))
+	if err != nil {
+		t.Fatalf("DecodeMessage: %s", err)
+	}
+	if msg.Short != short {
+		t.Errorf("msg.Short: expected %d bytes, got %d", len(short), len(msg.Short))
+	}
+}
+
+func TestSetStaticFields(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	if err = w.SetStaticFields(map[string]interface{}{"id": 1}); err != ErrReservedField {
+		t.Errorf("SetStaticFields with id: expected ErrReservedField, got %v", err)
+	}
+	if err = w.SetStaticFields(map[string]interface{}{"app": "api", "_env": "prod"}); err != nil {
+		t.Fatalf("SetStaticFields: %s", err)
+	}
+
+	m := &Message{Version: "1.1", Host: "h", Short: "static",
+		Extra: map[string]interface{}{"env": "staging", "user": "bob"}}
+	if err = w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if len(m.Extra) != 2 {
+		t.Errorf("WriteMessage modified the message's extra fields: %v", m.Extra)
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	for k, v := range map[string]string{"app": "api", "env": "staging", "user": "bob"} {
+		if msg.Extra[k] != v {
+			t.Errorf("msg.Extra[%q]: expected %s, got %v", k, v, msg.Extra[k])
+		}
+	}
+}
+
+func TestSetCallerInfo(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	logWrapped := func(short string) {
+		w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short})
+	}
+	readCaller := func() (string, int32) {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		return msg.File, msg.Line
+	}
+
+	logWrapped("off")
+	if file, line := readCaller(); file != "" || line != 0 {
+		t.Errorf("caller info off: expected no file, got %s:%d", file, line)
+	}
+
+	w.SetCallerInfo(0)
+	_, thisFile, thisLine, _ := runtime.Caller(0)
+	w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "direct"})
+	if file, line := readCaller(); file != thisFile || line != int32(thisLine+1) {
+		t.Errorf("expected %s:%d, got %s:%d", thisFile, thisLine+1, file, line)
+	}
+
+	w.SetCallerInfo(1)
+	_, _, thisLine, _ = runtime.Caller(0)
+	logWrapped("wrapped")
+	if file, line := readCaller(); file != thisFile || line != int32(thisLine+1) {
+		t.Errorf("with skip 1: expected %s:%d, got %s:%d", thisFile, thisLine+1, file, line)
+	}
+
+	w.SetCallerInfo(0)
+	_, _, thisLine, _ = runtime.Caller(0)
+	w.Write([]byte("written"))
+	if file, line := readCaller(); file != thisFile || line != int32(thisLine+1) {
+		t.Errorf("Write: expected %s:%d, got %s:%d", thisFile, thisLine+1, file, line)
+	}
+}
+
+// tests that messages compressed by reused compressors decode to
+// themselves, and nothing of the messages before them
+func TestWriteMessagePooledCompressors(t *testing.T) {
+	conn := new(recordingConn)
+	w := &Writer{conn: conn, hostname: "h"}
+
+	for i := 0; i < 20; i++ {
+		w.CompressionType = []CompressType{CompressGzip, CompressZlib}[i%2]
+		w.CompressionLevel = []int{flate.BestSpeed, flate.DefaultCompression, flate.BestCompression}[i%3]
+		short := strings.Repeat(strconv.Itoa(i), 10+i)
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+
+		msg, err := DecodeMessage(bytes.NewReader(conn.last))
+		if err != nil {
+			t.Fatalf("message %d: DecodeMessage: %s", i, err)
+		}
+		if msg.Short != short {
+			t.Errorf("message %d: expected %s, got %s", i, short, msg.Short)
+		}
+	}
+}
+
+// recordingConn keeps the last datagram written to it.
+type recordingConn struct {
+	net.Conn
+	last []byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.last = append(c.last[:0], b...)
+	return len(b), nil
+}
+
+func BenchmarkWriteMessageGzip(b *testing.B) {
+	w := &Writer{conn: new(countingConn), hostname: "bench", CompressionLevel: flate.BestSpeed}
+	m := &Message{
+		Version: "1.1",
+		Host:    w.hostname,
+		Short:   "short message",
+		Full:    "full message",
+		Level:   6,
+		Extra:   map[string]interface{}{"_file": "1234", "_line": "3456"},
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteMessage(m); err != nil {
+			b.Fatalf("WriteMessage: %s", err)
+		}
+	}
+}
+
+func TestWriteMessagesUDP(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	msgs := []*Message{
+		{Version: "1.1", Host: "h", Short: "0"},
+		{Version: "1.1", Host: "h", Short: "1", Extra: map[string]interface{}{"_id": 1}},
+		{Version: "1.1", Host: "h", Short: "2"},
+	}
+	err = w.WriteMessages(msgs)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 || !errors.Is(err, ErrReservedField) {
+		t.Fatalf("expected a BatchError for message 1, got %v", err)
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "0" {
+		t.Errorf("msg.Short: expected 0, got %s", msg.Short)
+	}
+}
+
+func TestSetCompressionThreshold(t *testing.T) {
+	conn := new(recordingConn)
+	w := &Writer{conn: conn, hostname: "h"}
+
+	if err := w.SetCompressionThreshold(-1); err == nil {
+		t.Errorf("SetCompressionThreshold accepted -1")
+	}
+	if err := w.SetCompressionThreshold(200); err != nil {
+		t.Fatalf("SetCompressionThreshold: %s", err)
+	}
+
+	for _, short := range []string{"tiny", strings.Repeat("long ", 100)} {
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+
+		compressed := bytes.HasPrefix(conn.last, magicGzip)
+		if compressed != (len(short) > 200) {
+			t.Errorf("message of %d bytes: compressed is %t", len(short), compressed)
+		}
+		msg, err := DecodeMessage(bytes.NewReader(conn.last))
+		if err != nil {
+			t.Fatalf("DecodeMessage: %s", err)
+		}
+		if msg.Short != short {
+			t.Errorf("expected %s, got %s", short, msg.Short)
+		}
+	}
+}
+
+func TestSetValidateOnly(t *testing.T) {
+	conn := new(recordingConn)
+	w := &Writer{conn: conn, hostname: "h"}
+	w.SetValidateOnly(true)
+
+	if err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "valid"}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+	}
+	if err := w.WriteMessage(&Message{Version: "2.0", Host: "h"}); err == nil {
+		t.Errorf("WriteMessage accepted an invalid message")
+	}
+	if _, err := w.Write([]byte("from Write")); err != nil {
+		t.Errorf("Write: %s", err)
+	}
+	err := w.WriteMessages([]*Message{
+		{Version: "1.1", Host: "h", Short: "batch"},
+		{Version: "1.1", Host: "h", Short: "reserved", Extra: map[string]interface{}{"_id": 1}},
+	})
+	if !errors.Is(err, ErrReservedField) {
+		t.Errorf("WriteMessages: expected ErrReservedField, got %v", err)
+	}
+
+	if conn.last != nil {
+		t.Errorf("a message was sent: %s", conn.last)
+	}
+	if n := w.ValidatedMessages(); n != 3 {
+		t.Errorf("ValidatedMessages: expected 3, got %d", n)
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	src, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer src.Close()
+	dst, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer dst.Close()
+
+	in, err := NewWriter(src.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer in.Close()
+	relay, err := NewWriter(dst.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer relay.Close()
+	relay.CompressionType = CompressNone
+	relay.SetChunkSize(200)
+
+	// relay a chunked message without re-encoding it
+	full := strings.Repeat("full ", 200)
+	if err = in.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "relayed", Full: full}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	_, raw, err := src.ReadMessageRaw()
+	if err != nil {
+		t.Fatalf("ReadMessageRaw: %s", err)
+	}
+	if err = relay.WriteRaw(raw); err != nil {
+		t.Fatalf("WriteRaw: %s", err)
+	}
+
+	msg, got, err := dst.ReadMessageRaw()
+	if err != nil {
+		t.Fatalf("ReadMessageRaw: %s", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Errorf("payload changed in transit:\n%s\n%s", raw, got)
+	}
+	if msg.Short != "relayed" || msg.Full != full {
+		t.Errorf("unexpected message %s", msg)
+	}
+
+	if err = relay.WriteRaw(nil); err == nil {
+		t.Errorf("WriteRaw accepted an empty payload")
+	}
+	if err = relay.WriteRaw(make([]byte, 129*200)); err == nil {
+		t.Errorf("WriteRaw accepted a payload needing more than 128 chunks")
+	}
+}
+
+func TestWriteRawValidateOnly(t *testing.T) {
+	w := &Writer{conn: new(recordingConn)}
+	w.SetValidateOnly(true)
+
+	if err := w.WriteRaw([]byte(`{"version":"1.1","host":"h","short_message":"ok"}`)); err != nil {
+		t.Errorf("WriteRaw: %s", err)
+	}
+	if err := w.WriteRaw([]byte(`{"version":"1.1","host":"h"}`)); err == nil {
+		t.Errorf("WriteRaw accepted a message without short_message")
+	}
+	if err := w.WriteRaw([]byte(`{`)); err == nil {
+		t.Errorf("WriteRaw accepted invalid JSON")
+	}
+	if n := w.ValidatedMessages(); n != 1 {
+		t.Errorf("ValidatedMessages: expected 1, got %d", n)
+	}
+}
+
+// deadlineConn is a conn whose writes all hang until the write
+// deadline, if any, and then time out; writes without a deadline, or
+// once stalled is false, succeed at once.
+type deadlineConn struct {
+	net.Conn
+	mu       sync.Mutex
+	deadline time.Time
+	stalled  bool
+	writes   int
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline, stalled := c.deadline, c.stalled
+	c.mu.Unlock()
+
+	if stalled && !deadline.IsZero() {
+		time.Sleep(time.Until(deadline))
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *deadlineConn) Close() error {
+	return nil
+}
+
+func TestSetWriteTimeout(t *testing.T) {
+	conn := &deadlineConn{stalled: true}
+	w := &Writer{conn: conn, CompressionType: CompressNone}
+
+	if err := w.SetWriteTimeout(-time.Second); err == nil {
+		t.Errorf("SetWriteTimeout accepted a negative timeout")
+	}
+	if err := w.SetWriteTimeout(20 * time.Millisecond); err != nil {
+		t.Fatalf("SetWriteTimeout: %s", err)
+	}
+
+	start := time.Now()
+	err := w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "slow"})
+	if !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("expected ErrWriteTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WriteMessage took %s, past the timeout", elapsed)
+	}
+
+	// the deadline covers every chunk of a chunked message
+	w.SetChunkSize(100)
+	err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: strings.Repeat("x", 500)})
+	if !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("chunked: expected ErrWriteTimeout, got %v", err)
+	}
+
+	conn.stalled = false
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "fast"}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+	}
+
+	// without a timeout, the deadline of the last write is gone
+	if err = w.SetWriteTimeout(0); err != nil {
+		t.Fatalf("SetWriteTimeout(0): %s", err)
+	}
+	conn.stalled = true
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "no timeout"}); err != nil {
+		t.Errorf("WriteMessage without a timeout: %s", err)
+	}
+}
+
+func TestSetVersion(t *testing.T) {
+	conn := new(recordingConn)
+	w := &Writer{conn: conn, CompressionType: CompressNone}
+
+	for _, v := range []string{"", "2.0", "1"} {
+		if err := w.SetVersion(v); err == nil {
+			t.Errorf("SetVersion accepted %q", v)
+		}
+	}
+
+	m := &Message{Version: "1.1", Host: "h", Short: "s"}
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if !bytes.Contains(conn.last, []byte(`"version":"1.1"`)) {
+		t.Errorf("expected version 1.1 by default, got %s", conn.last)
+	}
+	if err := w.WriteMessage(&Message{Host: "h", Short: "s"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if !bytes.Contains(conn.last, []byte(`"version":"1.1"`)) {
+		t.Errorf("expected version 1.1 for a message without one, got %s", conn.last)
+	}
+
+	if err := w.SetVersion("1.0"); err != nil {
+		t.Fatalf("SetVersion: %s", err)
+	}
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if !bytes.Contains(conn.last, []byte(`"version":"1.0"`)) {
+		t.Errorf("expected version 1.0, got %s", conn.last)
+	}
+	if m.Version != "1.1" {
+		t.Errorf("WriteMessage modified the message's Version")
+	}
+
+	if _, err := w.Write([]byte("line")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if !bytes.Contains(conn.last, []byte(`"version":"1.0"`)) {
+		t.Errorf("Write: expected version 1.0, got %s", conn.last)
+	}
+}
+
+func TestZlibDictionary(t *testing.T) {
+	dict := []byte(`{"version":"1.1","host":"web-frontend-01","short_message":"GET /api/v1/orders 200","level":6,"_service":"orders","_env":"production"}`)
+	m := &Message{
+		Version: "1.1",
+		Host:    "web-frontend-01",
+		Short:   "GET /api/v1/orders 200",
+		Level:   6,
+		Extra:   map[string]interface{}{"_service": "orders", "_env": "production"},
+	}
+
+	sizes := make(map[bool]int)
+	for _, withDict := range []bool{false, true} {
+		conn := new(recordingConn)
+		w := &Writer{conn: conn, CompressionType: CompressZlib, CompressionLevel: flate.BestCompression}
+		if withDict {
+			w.SetZlibDictionary(dict)
+		}
+		// twice, to reuse the pooled compressor
+		for i := 0; i < 2; i++ {
+			if err := w.WriteMessage(m); err != nil {
+				t.Fatalf("WriteMessage: %s", err)
+			}
+		}
+		sizes[withDict] = len(conn.last)
+
+		r, err := newReader(&replayConn{datagram: conn.last}, nil)
+		if err != nil {
+			t.Fatalf("newReader: %s", err)
+		}
+		r.SetZlibDictionary(dict)
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("dictionary %t: ReadMessage: %s", withDict, err)
+		}
+		if msg.Short != m.Short || msg.Transport.Compression != "zlib" {
+			t.Errorf("dictionary %t: unexpected message %+v", withDict, msg)
+		}
+
+		if withDict {
+			r.SetZlibDictionary(nil)
+			if _, err = r.ReadMessage(); !errors.Is(err, ErrDecompress) {
+				t.Errorf("without the dictionary: expected ErrDecompress, got %v", err)
+			}
+			r.SetZlibDictionary([]byte("another dictionary"))
+			if _, err = r.ReadMessage(); !errors.Is(err, ErrDecompress) {
+				t.Errorf("with another dictionary: expected ErrDecompress, got %v", err)
+			}
+		}
+	}
+
+	t.Logf("zlib message of %d bytes, %d with a dictionary", sizes[false], sizes[true])
+	if sizes[true] >= sizes[false]/2 {
+		t.Errorf("expected the dictionary to halve the size at least, got %d bytes from %d", sizes[true], sizes[false])
+	}
+}
+
+func TestWriterDefaultHost(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+
+	hostname, herr := os.Hostname()
+	if herr != nil {
+		hostname = "localhost"
+	}
+	if err = w.HostnameError(); err != herr {
+		t.Errorf("HostnameError: expected %v, got %v", herr, err)
+	}
+
+	send := func(host string) string {
+		t.Helper()
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: host, Short: "m"}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		return msg.Host
+	}
+
+	if host := send(""); host != hostname {
+		t.Errorf("default host: expected %q, got %q", hostname, host)
+	}
+	w.SetHost("web-1")
+	if host := send(""); host != "web-1" {
+		t.Errorf("SetHost: expected web-1, got %q", host)
+	}
+	if host := send("db-2"); host != "db-2" {
+		t.Errorf("message host: expected db-2, got %q", host)
+	}
+}
+
+func TestChunkMessage(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	chunks, err := ChunkMessage(payload, 112)
+	if err != nil {
+		t.Fatalf("ChunkMessage: %s", err)
+	}
+	if len(chunks) != 10 {
+		t.Fatalf("expected 10 chunks, got %d", len(chunks))
+	}
+	var joined []byte
+	for i, c := range chunks {
+		if len(c) > 112 {
+			t.Errorf("chunk %d: %d bytes, more than 112", i, len(c))
+		}
+		if !bytes.HasPrefix(c, magicChunked) || c[10] != byte(i) || c[11] != 10 {
+			t.Errorf("chunk %d: bad header % x", i, c[:chunkedHeaderLen])
+		}
+		if !bytes.Equal(c[2:10], chunks[0][2:10]) {
+			t.Errorf("chunk %d: message id % x, not % x", i, c[2:10], chunks[0][2:10])
+		}
+		joined = append(joined, c[chunkedHeaderLen:]...)
+	}
+	if !bytes.Equal(joined, payload) {
+		t.Errorf("chunk payloads don't add up to the message")
+	}
+
+	// a fresh id every time
+	again, _ := ChunkMessage(payload, 112)
+	if bytes.Equal(again[0][2:10], chunks[0][2:10]) {
+		t.Errorf("message id % x reused", chunks[0][2:10])
+	}
+
+	if chunks, err = ChunkMessage(nil, ChunkSize); err != nil || len(chunks) != 1 {
+		t.Errorf("empty payload: expected 1 chunk, got %d (%v)", len(chunks), err)
+	}
+	if _, err = ChunkMessage(payload, chunkedHeaderLen); err == nil {
+		t.Errorf("ChunkMessage accepted a chunk size leaving no room for data")
+	}
+	if _, err = ChunkMessage(make([]byte, 129*100), 100+chunkedHeaderLen); err == nil {
+		t.Errorf("ChunkMessage accepted a message of 129 chunks")
+	}
+}
+
+func TestSetMessageIDFunc(t *testing.T) {
+	// every chunked message sent, with a deterministic id
+	send := func() [][]byte {
+		w, r, err := NewMemoryReaderWriter()
+		if err != nil {
+			t.Fatalf("NewMemoryReaderWriter: %s", err)
+		}
+		defer r.Close()
+
+		var next byte
+		w.SetMessageIDFunc(func() [8]byte {
+			next++
+			return [8]byte{'i', 'd', 0, 0, 0, 0, 0, next}
+		})
+		w.CompressionType = CompressNone
+		w.SetChunkSize(100 + chunkedHeaderLen)
+		for i := 0; i < 2; i++ {
+			m := &Message{Version: "1.1", Host: "h", Short: strings.Repeat("x", 300), TimeUnix: 1}
+			if err := w.WriteMessage(m); err != nil {
+				t.Fatalf("WriteMessage: %s", err)
+			}
+		}
+		w.Close()
+
+		conn := r.conn.(*memConn)
+		return conn.queue
+	}
+
+	first, second := send(), send()
+	if len(first) != 8 {
+		t.Fatalf("expected 2 messages of 4 chunks, got %d datagrams", len(first))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Errorf("datagram %d differs between runs", i)
+		}
+	}
+	if id := first[4][2:10]; !bytes.Equal(id, []byte("id\x00\x00\x00\x00\x00\x02")) {
+		t.Errorf("second message: expected id 2, got % x", id)
+	}
+}
+
+func TestWriterExtraKeyPolicy(t *testing.T) {
+	w, r, err := NewMemoryReaderWriter()
+	if err != nil {
+		t.Fatalf("NewMemoryReaderWriter: %s", err)
+	}
+	defer r.Close()
+
+	if err = w.SetExtraKeyPolicy(ExtraKeyDrop + 1); err == nil {
+		t.Errorf("SetExtraKeyPolicy accepted an unknown policy")
+	}
+	if err = w.SetExtraKeyPolicy(ExtraKeyReplace); err != nil {
+		t.Fatalf("SetExtraKeyPolicy: %s", err)
+	}
+
+	m := &Message{Version: "1.1", Host: "h", Short: "m",
+		Extra: map[string]interface{}{"_request id": "r1", "_region": "eu"}}
+	if err = w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if _, ok := m.Extra["_request id"]; !ok {
+		t.Errorf("WriteMessage modified the message passed in")
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	expected := map[string]interface{}{"request_id": "r1", "region": "eu"}
+	if !reflect.DeepEqual(msg.Extra, expected) {
+		t.Errorf("Extra: expected %v, got %v", expected, msg.Extra)
+	}
+}
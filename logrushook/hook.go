@@ -0,0 +1,119 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package logrushook sends logrus entries as GELF messages.
+package logrushook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+// Hook is a logrus.Hook sending every entry it fires for as a GELF
+// message: the entry's message becomes the short message, and its
+// fields become additional fields.  GELF field values are numbers or
+// strings, so other values are sent as strings, maps and slices as
+// JSON.
+type Hook struct {
+	w      gelf.MessageWriter
+	host   string
+	levels []logrus.Level
+}
+
+// New returns a hook sending entries of every level through w, a
+// gelf.Writer or gelf.AsyncWriter.  An AsyncWriter keeps logging from
+// waiting on the network.
+func New(w gelf.MessageWriter) *Hook {
+	h := &Hook{w: w, levels: logrus.AllLevels}
+	h.host, _ = os.Hostname()
+	return h
+}
+
+// SetLevels restricts the hook to entries of the given levels.
+func (h *Hook) SetLevels(levels ...logrus.Level) {
+	h.levels = levels
+}
+
+// Levels returns the levels the hook fires for.
+func (h *Hook) Levels() []logrus.Level {
+	return h.levels
+}
+
+// Fire sends entry as a GELF message.
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	m := &gelf.Message{
+		Version: "1.1",
+		Host:    h.host,
+		Short:   entry.Message,
+		Level:   level(entry.Level),
+	}
+	if !entry.Time.IsZero() {
+		m.SetTime(entry.Time)
+	}
+	if entry.HasCaller() {
+		m.File = entry.Caller.File
+		m.Line = int32(entry.Caller.Line)
+	}
+
+	if len(entry.Data) > 0 {
+		m.Extra = make(map[string]interface{}, len(entry.Data))
+		for k, v := range entry.Data {
+			m.Extra[k] = value(v)
+		}
+		// "id" is reserved by GELF
+		m.SanitizeExtras()
+	}
+
+	return h.w.WriteMessage(m)
+}
+
+// level maps a logrus level to the closest syslog severity.
+func level(l logrus.Level) int32 {
+	switch l {
+	case logrus.PanicLevel:
+		return gelf.LevelAlert
+	case logrus.FatalLevel:
+		return gelf.LevelCritical
+	case logrus.ErrorLevel:
+		return gelf.LevelError
+	case logrus.WarnLevel:
+		return gelf.LevelWarning
+	case logrus.InfoLevel:
+		return gelf.LevelInfo
+	}
+	return gelf.LevelDebug
+}
+
+// value converts v to a number or string, the only kinds of values
+// GELF fields may have.
+func value(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string, float64, float32, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, json.Number:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case time.Duration:
+		return x.String()
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,90 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package logrushook
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+// recorder keeps the messages written to it.
+type recorder []*gelf.Message
+
+func (r *recorder) WriteMessage(m *gelf.Message) error {
+	*r = append(*r, m)
+	return nil
+}
+
+func newLogger(h *Hook) *logrus.Logger {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	l.Level = logrus.DebugLevel
+	l.AddHook(h)
+	return l
+}
+
+func TestFire(t *testing.T) {
+	var rec recorder
+	l := newLogger(New(&rec))
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.WithTime(at).WithFields(logrus.Fields{
+		"user":  "bob",
+		"n":     3,
+		"ok":    true,
+		"err":   errors.New("boom"),
+		"tags":  []string{"a", "b"},
+		"attrs": map[string]int{"x": 1},
+		"id":    42,
+	}).Warn("something odd")
+
+	if len(rec) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(rec))
+	}
+	m := rec[0]
+	if m.Short != "something odd" || m.Level != gelf.LevelWarning || !m.Time().Equal(at) {
+		t.Errorf("unexpected message %s", m)
+	}
+
+	expected := map[string]interface{}{
+		"user":    "bob",
+		"n":       3,
+		"ok":      "true",
+		"err":     "boom",
+		"tags":    `["a","b"]`,
+		"attrs":   `{"x":1}`,
+		"orig_id": 42,
+	}
+	if len(m.Extra) != len(expected) {
+		t.Errorf("expected extra fields %v, got %v", expected, m.Extra)
+	}
+	for k, v := range expected {
+		if m.Extra[k] != v {
+			t.Errorf("Extra[%q]: expected %v, got %v", k, v, m.Extra[k])
+		}
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	var rec recorder
+	h := New(&rec)
+	if len(h.Levels()) != len(logrus.AllLevels) {
+		t.Errorf("expected all levels by default, got %v", h.Levels())
+	}
+	h.SetLevels(logrus.ErrorLevel)
+	l := newLogger(h)
+
+	l.Info("skipped")
+	l.Error("sent")
+
+	if len(rec) != 1 || rec[0].Short != "sent" || rec[0].Level != gelf.LevelError {
+		t.Errorf("expected only the error, got %v", rec)
+	}
+}